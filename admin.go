@@ -0,0 +1,257 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The REDIX command family, used to inspect and control the proxy.
+var redixHelp = []string{
+	"REDIX <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"INFO",
+	"    Return information about the proxy.",
+	"CLIENTS",
+	"    Return information about client connections.",
+	"KILL <addr>",
+	"    Kill the client connected from <addr> (ip:port).",
+	"BACKENDS",
+	"    Return the master and replicas known to the proxy.",
+	"CONFIG GET <pattern>",
+	"    Return parameters matching the glob-like <pattern> and their values.",
+	"CONFIG SET <parameter> <value>",
+	"    Set the parameter to the value. Applies to new connections.",
+	"CONFIG REWRITE",
+	"    Rewrite the config file with the running configuration.",
+	"SLOWLOG GET [<count>]",
+	"    Return up to <count> (default 10, -1 for all) of the slowest recent commands.",
+	"SLOWLOG LEN",
+	"    Return the number of entries in the slowlog.",
+	"SLOWLOG RESET",
+	"    Clear the slowlog.",
+	"COMMAND INFO <command> [<command> ...]",
+	"    Return the proxy's description of the commands, as Redis's COMMAND INFO.",
+	"MIGRATE STATUS",
+	"    Return the progress of the migration to migration.target.",
+	"MIGRATE COPY",
+	"    Copy every key of the backend to the migration target in the background.",
+	"MIGRATE CUTOVER <timeout> [FORCE]",
+	"    Switch to the migration target once pending keys are copied, within <timeout> ms.",
+	"    Unless FORCE, the existing keys must have been copied without failures.",
+	"COMMANDSTATS",
+	"    Return per command calls, failures, rejections, latency and sizes, as INFO commandstats.",
+	"COMMANDSTATS RESET",
+	"    Reset the command stats.",
+	"HOTKEYS [<count>]",
+	"    Return up to <count> of the most accessed keys, with their db and estimated accesses.",
+	"BIGKEYS [<count>]",
+	"    Return up to <count> of the keys with the largest requests or replies, with their db and sizes.",
+	"TAP <pattern> [<pattern> ...]",
+	"    Stream the commands whose name or keys match a glob-like <pattern>, as MONITOR.",
+	"CAPTURE START",
+	"    Record the commands clients send to capture.file, for redix-replay.",
+	"CAPTURE STOP",
+	"    Stop recording and return the number of commands recorded.",
+	"UPGRADE",
+	"    Hand the listening sockets to a new copy of the binary and drain this one.",
+	"HELP",
+	"    Print this help.",
+}
+
+// Subcommands, with their own subcommand if they have one, that change the
+// proxy or expose other clients' commands and keys, and are only run by
+// auth.admins
+var redixAdminCommands = map[string]bool{
+	"kill":            true,
+	"config set":      true,
+	"config rewrite":  true,
+	"slowlog get":     true,
+	"slowlog reset":   true,
+	"hotkeys":         true,
+	"bigkeys":         true,
+	"tap":             true,
+	"capture":         true,
+	"migrate copy":    true,
+	"migrate cutover": true,
+	"upgrade":         true,
+}
+
+// Rejects commands only admins may run, eg: redix|upgrade. Clients in a
+// namespace must be listed in auth.admins, since those commands reach
+// beyond it.
+func (server *Server) checkAdmin(proxy *Proxy, name string) Resp {
+	auth := server.Configs.Config().Auth
+	if auth.Admin(proxy.User()) && (proxy.Namespace() == "" || len(auth.Admins) > 0) {
+		return nil
+	}
+	return Error(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", proxy.User(), name))
+}
+
+func (server *Server) redix(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) < 2 {
+		return nil, wrongArgs("redix")
+	}
+	sub := strings.ToLower(args[1].String())
+	name := sub
+	if len(args) > 2 && redixAdminCommands[sub+" "+strings.ToLower(args[2].String())] {
+		name = sub + " " + strings.ToLower(args[2].String())
+	}
+	if redixAdminCommands[name] {
+		if denied := server.checkAdmin(proxy, "redix|"+strings.Replace(name, " ", "|", -1)); denied != nil {
+			return denied, nil
+		}
+	}
+	switch sub {
+	case "info":
+		return BulkString(server.info()), nil
+	case "clients":
+		var lines string
+		for _, client := range server.Clients() {
+			lines += client.ClientInfo() + "\n"
+		}
+		return BulkString(lines), nil
+	case "kill":
+		if len(args) != 3 {
+			return nil, wrongArgs("redix|kill")
+		}
+		addr := args[2].String()
+		for _, client := range server.Clients() {
+			if client.ClientAddr() == addr {
+				client.Close()
+				return SimpleString("OK"), nil
+			}
+		}
+		return nil, errors.New("No such client")
+	case "backends":
+		cfg := server.Configs.Config()
+		backends := Array{BulkString("master " + server.Dialer.Addr())}
+		for _, replica := range cfg.Replicas {
+			ip, port, _, _ := ParseRedisURL(replica)
+			backends = append(backends, BulkString("replica "+ip+":"+port))
+		}
+		return backends, nil
+	case "config":
+		return server.config(proxy, args)
+	case "slowlog":
+		return server.slowlogCommand(proxy, args)
+	case "command":
+		if len(args) < 4 || strings.ToLower(args[2].String()) != "info" {
+			return nil, wrongArgs("redix|command")
+		}
+		infos := Array{}
+		for _, name := range args[3:] {
+			if info, ok := LookupCommand(name.String()); ok {
+				infos = append(infos, info.Reply())
+			} else {
+				infos = append(infos, Array(nil))
+			}
+		}
+		return infos, nil
+	case "commandstats":
+		return server.commandStatsCommand(proxy, args)
+	case "hotkeys":
+		return server.hotKeysCommand(proxy, args)
+	case "bigkeys":
+		return server.bigKeysCommand(proxy, args)
+	case "tap":
+		if len(args) < 3 {
+			return nil, wrongArgs("redix|tap")
+		}
+		var patterns []string
+		for _, pattern := range args[2:] {
+			patterns = append(patterns, pattern.String())
+		}
+		server.monitors.add(proxy, patterns)
+		return nil, nil
+	case "capture":
+		return server.captureCommand(proxy, args)
+	case "migrate":
+		return server.migrate(proxy, args)
+	case "upgrade":
+		if _, err := server.Upgrade(); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	case "help":
+		var help Array
+		for _, line := range redixHelp {
+			help = append(help, SimpleString(line))
+		}
+		return help, nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try REDIX HELP.", args[1].String())
+	}
+}
+
+// REDIX CONFIG GET|SET|REWRITE
+func (server *Server) config(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) < 3 {
+		return nil, wrongArgs("redix|config")
+	}
+	switch strings.ToLower(args[2].String()) {
+	case "get":
+		if len(args) != 4 {
+			return nil, wrongArgs("redix|config|get")
+		}
+		var params Array
+		for _, param := range server.Configs.Config().Get(args[3].String()) {
+			params = append(params, BulkString(param[0]), BulkString(param[1]))
+		}
+		if params == nil {
+			params = Array{}
+		}
+		return params, nil
+	case "set":
+		if len(args) != 5 {
+			return nil, wrongArgs("redix|config|set")
+		}
+		var setErr error
+		err := server.Configs.Update(func(cfg *Config) {
+			setErr = cfg.Set(args[3].String(), args[4].String())
+		})
+		if setErr != nil {
+			return nil, setErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	case "rewrite":
+		if err := server.Configs.Rewrite(); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try REDIX HELP.", args[2].String())
+	}
+}
+
+func (server *Server) info() string {
+	uptime := time.Since(server.started)
+	cache := server.cache.Stats()
+	lines := []string{
+		"# Proxy",
+		"redix_version:" + Version,
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime.Seconds())),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime.Hours()/24)),
+		"",
+		"# Clients",
+		fmt.Sprintf("connected_clients:%d", server.NumClients()),
+		"",
+		"# Backend",
+		"backend:" + server.Dialer.Addr(),
+		fmt.Sprintf("backend_connections:%d", server.Conns.Len()),
+		"",
+		"# Cache",
+		fmt.Sprintf("cache_hits:%d", cache.Hits),
+		fmt.Sprintf("cache_misses:%d", cache.Misses),
+		fmt.Sprintf("cache_entries:%d", cache.Entries),
+		fmt.Sprintf("cache_bytes:%d", cache.Bytes),
+		fmt.Sprintf("cache_evictions:%d", cache.Evictions),
+		fmt.Sprintf("cache_invalidations:%d", cache.Invalidations),
+		"cache_tracking:" + cache.Tracking,
+		"",
+	}
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,602 @@
+package redix
+
+import (
+	"container/list"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Read commands whose replies are cached. They take a single key and reply
+// deterministically.
+var cachedCommands = map[string]bool{
+	"get": true, "getrange": true, "substr": true, "strlen": true, "getbit": true,
+	"bitcount": true, "bitpos": true, "type": true,
+	"hget": true, "hmget": true, "hgetall": true, "hkeys": true, "hvals": true,
+	"hlen": true, "hstrlen": true, "hexists": true,
+	"lrange": true, "lindex": true, "llen": true, "lpos": true,
+	"smembers": true, "sismember": true, "smismember": true, "scard": true,
+	"zrange": true, "zrevrange": true, "zrangebyscore": true, "zrevrangebyscore": true,
+	"zrangebylex": true, "zrevrangebylex": true, "zscore": true, "zmscore": true,
+	"zcard": true, "zcount": true, "zlexcount": true, "zrank": true, "zrevrank": true,
+}
+
+const (
+	// The channel invalidations are published to in RESP2
+	invalidationChannel = "__redis__:invalidate"
+	// Wait between attempts to subscribe to invalidations
+	trackingRetry = time.Second
+	// Accounts for the bookkeeping of an entry in its size
+	cacheEntryOverhead = 128
+)
+
+type cacheEntry struct {
+	id, key string
+	reply   Resp
+	size    int
+	expires time.Time
+}
+
+// A reply being fetched from the backend, which mustn't be cached if its
+// key is invalidated meanwhile
+type cacheFill struct {
+	stale bool
+}
+
+// CacheStats counts the near cache's activity since it was last configured
+type CacheStats struct {
+	Hits, Misses  int64
+	Entries       int
+	Bytes         int
+	Evictions     int64
+	Invalidations int64
+	// off, connected or disconnected
+	Tracking string
+}
+
+// nearCache keeps replies to read commands in memory, evicting the least
+// recently used past its memory limit. Writes made through the proxy and,
+// with tracking, the backend's invalidation messages remove them.
+type nearCache struct {
+	mu      sync.Mutex
+	cfg     CacheConfig
+	lru     *list.List
+	entries map[string]*list.Element
+	// Entry ids by key
+	byKey map[string]map[string]struct{}
+	fills map[string]map[*cacheFill]struct{}
+	bytes int
+	// Replies are only served and stored while tracking is connected
+	ready bool
+	// Closed to stop tracking
+	stop  chan struct{}
+	stats CacheStats
+}
+
+func newNearCache() *nearCache {
+	cache := &nearCache{stats: CacheStats{Tracking: "off"}}
+	cache.reset()
+	return cache
+}
+
+// Call with the lock held
+func (cache *nearCache) reset() {
+	cache.lru = list.New()
+	cache.entries = map[string]*list.Element{}
+	cache.byKey = map[string]map[string]struct{}{}
+	cache.bytes = 0
+	for _, fills := range cache.fills {
+		for fill := range fills {
+			fill.stale = true
+		}
+	}
+	cache.fills = map[string]map[*cacheFill]struct{}{}
+}
+
+// Applies the config, emptying the cache if it changed
+func (cache *nearCache) configure(cfg CacheConfig, dialer *Dialer, logger *slog.Logger) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if reflect.DeepEqual(cfg, cache.cfg) {
+		return
+	}
+	if cache.stop != nil {
+		close(cache.stop)
+		cache.stop = nil
+	}
+	cache.cfg = cfg
+	cache.reset()
+	cache.stats = CacheStats{Tracking: "off"}
+	cache.ready = len(cfg.Keys) > 0 && !cfg.Tracking
+	if len(cfg.Keys) > 0 && cfg.Tracking {
+		cache.stats.Tracking = "disconnected"
+		cache.stop = make(chan struct{})
+		go cache.track(dialer, logger, trackingPrefixes(cfg.Keys), cache.stop)
+	}
+}
+
+func (cache *nearCache) close() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.stop != nil {
+		close(cache.stop)
+		cache.stop = nil
+	}
+}
+
+func (cache *nearCache) Stats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Entries, stats.Bytes = cache.lru.Len(), cache.bytes
+	return stats
+}
+
+func (cache *nearCache) enabled() bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.cfg.Keys) > 0
+}
+
+// Reports whether the key's replies are cached
+func (cache *nearCache) matches(key string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, pattern := range cache.cfg.Keys {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a cached reply, or starts filling the entry if it missed. The
+// fill is nil if the reply can't be cached at the moment.
+func (cache *nearCache) get(id, key string) (Resp, *cacheFill) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if !cache.ready {
+		return nil, nil
+	}
+	if elem, ok := cache.entries[id]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			cache.lru.MoveToFront(elem)
+			cache.stats.Hits++
+			return entry.reply, nil
+		}
+		cache.remove(elem)
+	}
+	cache.stats.Misses++
+	fill := &cacheFill{}
+	if cache.fills[key] == nil {
+		cache.fills[key] = map[*cacheFill]struct{}{}
+	}
+	cache.fills[key][fill] = struct{}{}
+	return nil, fill
+}
+
+// Stores the reply of a fill started by get, unless its key was invalidated
+// since. A nil reply abandons the fill.
+func (cache *nearCache) put(fill *cacheFill, id, key string, reply Resp) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if fills, ok := cache.fills[key]; ok {
+		delete(fills, fill)
+		if len(fills) == 0 {
+			delete(cache.fills, key)
+		}
+	}
+	if reply == nil || fill.stale {
+		return
+	}
+	if elem, ok := cache.entries[id]; ok {
+		cache.remove(elem)
+	}
+	entry := &cacheEntry{id: id, key: key, reply: reply, size: len(id) + len(reply.Raw()) + cacheEntryOverhead}
+	if entry.size > cache.cfg.MaxBytes {
+		return
+	}
+	if ttl := time.Duration(cache.cfg.TTL); ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	cache.entries[id] = cache.lru.PushFront(entry)
+	if cache.byKey[key] == nil {
+		cache.byKey[key] = map[string]struct{}{}
+	}
+	cache.byKey[key][id] = struct{}{}
+	cache.bytes += entry.size
+	for cache.bytes > cache.cfg.MaxBytes {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+// Call with the lock held
+func (cache *nearCache) remove(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*cacheEntry)
+	delete(cache.entries, entry.id)
+	if ids, ok := cache.byKey[entry.key]; ok {
+		delete(ids, entry.id)
+		if len(ids) == 0 {
+			delete(cache.byKey, entry.key)
+		}
+	}
+	cache.bytes -= entry.size
+}
+
+// Removes the replies of the keys, and those being fetched
+func (cache *nearCache) invalidate(keys []string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, key := range keys {
+		for id := range cache.byKey[key] {
+			cache.remove(cache.entries[id])
+			cache.stats.Invalidations++
+		}
+		for fill := range cache.fills[key] {
+			fill.stale = true
+		}
+	}
+}
+
+// Removes every reply
+func (cache *nearCache) flush() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.stats.Invalidations += int64(cache.lru.Len())
+	cache.reset()
+}
+
+// Removes the replies of the keys a write changes
+func (cache *nearCache) invalidateWrite(info CommandInfo, cmd Array) {
+	if keys, flush := writtenKeys(info, cmd); flush {
+		cache.flush()
+	} else {
+		cache.invalidate(keys)
+	}
+}
+
+// Ignored from a tracker that has been stopped
+func (cache *nearCache) setTracking(stop chan struct{}, connected bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.stop != stop {
+		return
+	}
+	// Invalidations may have been missed
+	cache.reset()
+	cache.ready = connected
+	if connected {
+		cache.stats.Tracking = "connected"
+	} else {
+		cache.stats.Tracking = "disconnected"
+	}
+}
+
+// The literal prefixes of the patterns, for CLIENT TRACKING BCAST. None
+// means every key.
+func trackingPrefixes(patterns []string) []string {
+	var prefixes []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		prefix := pattern
+		if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+			prefix = pattern[:i]
+		}
+		if prefix == "" {
+			return nil
+		}
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	// Redis rejects overlapping prefixes
+	var disjoint []string
+	for _, prefix := range prefixes {
+		overlaps := false
+		for _, other := range prefixes {
+			if other != prefix && strings.HasPrefix(prefix, other) {
+				overlaps = true
+			}
+		}
+		if !overlaps {
+			disjoint = append(disjoint, prefix)
+		}
+	}
+	return disjoint
+}
+
+// Subscribes to the backend's invalidations of the prefixes until stop is
+// closed, reconnecting when the connection fails or the backend changes
+func (cache *nearCache) track(dialer *Dialer, logger *slog.Logger, prefixes []string, stop chan struct{}) {
+	for {
+		err := cache.subscribe(dialer, prefixes, stop)
+		cache.setTracking(stop, false)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logger.Warn("cache invalidations interrupted", "error", err)
+		select {
+		case <-time.After(trackingRetry):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (cache *nearCache) subscribe(dialer *Dialer, prefixes []string, stop chan struct{}) error {
+	conn, err := dialer.Dial()
+	if err != nil {
+		return err
+	}
+	addr := dialer.Addr()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(trackingRetry)
+		defer ticker.Stop()
+		defer conn.Close()
+		for {
+			select {
+			case <-ticker.C:
+				if dialer.Addr() != addr {
+					return
+				}
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	reader := NewReader(conn)
+	do := func(args ...string) (Resp, error) {
+		cmd := Array{}
+		for _, arg := range args {
+			cmd = append(cmd, BulkString(arg))
+		}
+		if _, err := conn.Write(cmd.Raw()); err != nil {
+			return nil, err
+		}
+		reply, err := reader.ParseObject()
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := reply.(Error); ok {
+			return nil, errors.New(e.String())
+		}
+		return reply, nil
+	}
+
+	// Invalidations are redirected to this connection once subscribed
+	id, err := do("CLIENT", "ID")
+	if err != nil {
+		return err
+	}
+	tracking := []string{"CLIENT", "TRACKING", "ON", "REDIRECT", id.String(), "BCAST"}
+	for _, prefix := range prefixes {
+		tracking = append(tracking, "PREFIX", prefix)
+	}
+	if _, err := do(tracking...); err != nil {
+		return err
+	}
+	if _, err := do("SUBSCRIBE", invalidationChannel); err != nil {
+		return err
+	}
+	cache.setTracking(stop, true)
+
+	for {
+		reply, err := reader.ParseObject()
+		if err != nil {
+			return err
+		}
+		// message, channel, keys
+		message, ok := reply.(Array)
+		if !ok || len(message) != 3 || message[0].String() != "message" {
+			continue
+		}
+		keys, ok := message[2].(Array)
+		if !ok || keys == nil {
+			// The backend flushed its keys
+			cache.flush()
+			continue
+		}
+		invalidated := make([]string, len(keys))
+		for i, key := range keys {
+			invalidated[i] = key.String()
+		}
+		cache.invalidate(invalidated)
+	}
+}
+
+// Serves reads of cached keys from the cache, and invalidates the keys
+// written through the proxy
+func (server *Server) cacheReads(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || !server.cache.enabled() {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	info, known := lookupCommand(cmd)
+	db, multi := proxy.session()
+
+	switch {
+	case name == "exec":
+		reply, err := next(ctx, cmd)
+		for _, queued := range proxy.txWrites {
+			info, _ := lookupCommand(queued)
+			server.cache.invalidateWrite(info, queued)
+		}
+		return reply, err
+	case !known || multi:
+		// Replies to queued commands are sent by EXEC
+		return next(ctx, cmd)
+	case writes(info):
+		reply, err := next(ctx, cmd)
+		server.cache.invalidateWrite(info, cmd)
+		return reply, err
+	case !cachedCommands[name] || len(cmd) < 2:
+		return next(ctx, cmd)
+	}
+
+	key := cmd[1].String()
+	if !server.cache.matches(key) {
+		return next(ctx, cmd)
+	}
+	// Replies are cached per backend, user and db
+	id := commandID(proxy.Backend(), proxy.BackendUser(), db, cmd)
+	cached, fill := server.cache.get(id, key)
+	if cached != nil {
+		return cached, nil
+	}
+	reply, err := next(ctx, cmd)
+	if fill != nil {
+		if _, failed := reply.(Error); err != nil || failed {
+			server.cache.put(fill, id, key, nil)
+		} else {
+			server.cache.put(fill, id, key, reply)
+		}
+	}
+	return reply, err
+}
+
+// Records the writes queued in a transaction for the interceptors that run
+// on its EXEC, before they are forgotten
+func (server *Server) trackTransactions(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	switch name {
+	case "exec", "discard":
+		defer func() { proxy.txWrites = nil }()
+		return next(ctx, cmd)
+	}
+	if _, multi := proxy.session(); multi {
+		if info, known := lookupCommand(cmd); known && writes(info) {
+			proxy.txWrites = append(proxy.txWrites, cmd)
+		}
+	}
+	return next(ctx, cmd)
+}
+
+// Identifies a command sent to a backend's db by its arguments. Users may
+// not be allowed to run each other's commands, so theirs are told apart.
+func commandID(backend, user, db string, cmd Array) string {
+	var id strings.Builder
+	id.WriteString(backend + "\x00" + user + "\x00" + db + "\x00" + strings.ToLower(cmd[0].String()))
+	for _, arg := range cmd[1:] {
+		id.WriteString("\x00" + strconv.Itoa(len(arg.String())) + ":" + arg.String())
+	}
+	return id.String()
+}
+
+// Scripts and functions may write to their keys
+func writes(info CommandInfo) bool {
+	return info.Write() || info.HasFlag("may_replicate") && info.InCategory("@scripting")
+}
+
+// Returns the keys a write command changes, or whether it may change any
+func writtenKeys(info CommandInfo, cmd Array) ([]string, bool) {
+	keys, err := info.Keys(cmd)
+	if err != nil {
+		return nil, true
+	}
+	if len(keys) == 0 && info.InCategory("@keyspace") {
+		// FLUSHALL, FLUSHDB, SWAPDB
+		return nil, true
+	}
+	return keys, false
+}
+
+// Matches a string against a Redis glob-style pattern: * ? [abc] [^a-z] and
+// backslash escapes
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// Taken literally
+				if s[0] != '[' {
+					return false
+				}
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+			class := pattern[1 : end+1]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if class[i] == '\\' && i+1 < len(class) {
+					i++
+					matched = matched || class[i] == s[0]
+				} else if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || lo <= s[0] && s[0] <= hi
+					i += 2
+				} else {
+					matched = matched || class[i] == s[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
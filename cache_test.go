@@ -0,0 +1,120 @@
+package redix_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	var (
+		backend  *fakeRedis
+		addr     string
+		stop     func()
+		client   *testClient
+		tracking bool
+	)
+
+	info := func() string {
+		return client.Do("REDIX", "INFO").String()
+	}
+
+	JustBeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Cache.Keys = []string{"hot:*"}
+		cfg.Cache.Tracking = tracking
+		server := redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	Context("Without tracking", func() {
+		BeforeEach(func() {
+			tracking = false
+		})
+
+		It("Should serve reads of cached keys from the proxy.", func() {
+			client.Do("SET", "hot:1", "a")
+			client.Do("SET", "cold:1", "b")
+			for i := 0; i < 3; i++ {
+				Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+				Expect(client.Do("GET", "cold:1").String()).To(Equal("b"))
+			}
+			Expect(backend.Gets()).To(Equal(4))
+			Expect(info()).To(ContainSubstring("cache_hits:2\r\n"))
+			Expect(info()).To(ContainSubstring("cache_misses:1\r\n"))
+			Expect(info()).To(ContainSubstring("cache_tracking:off\r\n"))
+		})
+		It("Should not share replies between backend users.", func() {
+			client.Do("SET", "hot:1", "a")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+
+			other := dialProxy(addr)
+			defer other.Close()
+			Expect(other.Do("AUTH", "reader", "r").String()).To(Equal("OK"))
+			Expect(other.Do("GET", "hot:1").String()).To(Equal("a"))
+			Expect(other.Do("GET", "hot:1").String()).To(Equal("a"))
+			Expect(backend.Gets()).To(Equal(2))
+		})
+		It("Should invalidate keys written through the proxy.", func() {
+			client.Do("SET", "hot:1", "a")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+			client.Do("SET", "hot:1", "b")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("b"))
+
+			// The backend doesn't queue commands, but the proxy mustn't reply
+			// to those in a transaction from the cache
+			gets := backend.Gets()
+			client.Do("MULTI")
+			client.Do("SET", "hot:1", "c")
+			client.Do("GET", "hot:1")
+			Expect(backend.Gets()).To(Equal(gets + 1))
+			client.Do("EXEC")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("c"))
+
+			client.Do("FLUSHALL")
+			Expect(client.Do("GET", "hot:1")).To(Equal(redix.BulkString(nil)))
+		})
+		It("Should cache replies per db.", func() {
+			client.Do("SET", "hot:1", "a")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+			client.Do("SELECT", "1")
+			client.Do("GET", "hot:1")
+			Expect(backend.Gets()).To(Equal(2))
+		})
+	})
+
+	Context("With tracking", func() {
+		BeforeEach(func() {
+			tracking = true
+		})
+
+		It("Should invalidate keys written by other clients.", func() {
+			Eventually(info).Should(ContainSubstring("cache_tracking:connected\r\n"))
+			client.Do("SET", "hot:1", "a")
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+			Expect(client.Do("GET", "hot:1").String()).To(Equal("a"))
+			Expect(backend.Gets()).To(Equal(1))
+
+			direct := dialProxy(strings.TrimPrefix(backend.URL(), "redis://"))
+			defer direct.Close()
+			direct.Do("SET", "hot:1", "b")
+			Eventually(func() string {
+				return client.Do("GET", "hot:1").String()
+			}, time.Second).Should(Equal("b"))
+			Expect(info()).To(ContainSubstring("cache_invalidations:1\r\n"))
+		})
+	})
+})
@@ -0,0 +1,312 @@
+package redix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Capture files start with captureMagic, followed by a record per command:
+//
+//	varint   nanoseconds since the previous record, or the Unix epoch
+//	uvarint  client connection id
+//	uvarint  length of the request, then the request in RESP
+//	uvarint  length of the reply plus one, or zero if there is none, then
+//	         the reply in RESP
+const captureMagic = "REDIXCAP1\n"
+
+// Unflushed records are written out this often while capturing
+const captureFlushInterval = time.Second
+
+var errCaptureFull = errors.New("the capture reached capture.max_bytes")
+
+// CaptureRecord is a command read off a client connection
+type CaptureRecord struct {
+	// When the command was read
+	Time time.Time
+	// The client connection it was read from
+	Conn    int64
+	Request Array
+	// Nil unless replies are captured
+	Reply Resp
+}
+
+// CaptureWriter writes records to a capture file
+type CaptureWriter struct {
+	writer *bufio.Writer
+	last   int64
+	size   int64
+}
+
+// NewCaptureWriter starts a capture file
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	writer := &CaptureWriter{writer: bufio.NewWriter(w), size: int64(len(captureMagic))}
+	if _, err := writer.writer.WriteString(captureMagic); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (writer *CaptureWriter) Write(record CaptureRecord) error {
+	now := record.Time.UnixNano()
+	request := record.Request.Raw()
+	// Zero for no reply
+	var reply []byte
+	var replyLen uint64
+	if record.Reply != nil {
+		reply = record.Reply.Raw()
+		replyLen = uint64(len(reply)) + 1
+	}
+
+	header := make([]byte, 0, 4*binary.MaxVarintLen64)
+	header = binary.AppendVarint(header, now-writer.last)
+	header = binary.AppendUvarint(header, uint64(record.Conn))
+	header = binary.AppendUvarint(header, uint64(len(request)))
+	writer.last = now
+	for _, part := range [][]byte{header, request, binary.AppendUvarint(nil, replyLen), reply} {
+		n, err := writer.writer.Write(part)
+		writer.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the number of bytes written so far
+func (writer *CaptureWriter) Size() int64 {
+	return writer.size
+}
+
+func (writer *CaptureWriter) Flush() error {
+	return writer.writer.Flush()
+}
+
+// CaptureReader reads the records of a capture file
+type CaptureReader struct {
+	reader *bufio.Reader
+	last   int64
+}
+
+// NewCaptureReader checks that r is a capture file
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	reader := &CaptureReader{reader: bufio.NewReader(r)}
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(reader.reader, magic); err != nil || string(magic) != captureMagic {
+		return nil, errors.New("not a capture file")
+	}
+	return reader, nil
+}
+
+// Read returns the next record, or io.EOF at the end of the file
+func (reader *CaptureReader) Read() (CaptureRecord, error) {
+	var record CaptureRecord
+	delta, err := binary.ReadVarint(reader.reader)
+	if err != nil {
+		// io.EOF if the file ends between records
+		return record, err
+	}
+	conn, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return record, unexpectedEOF(err)
+	}
+	request, err := reader.readResp(0)
+	if err != nil {
+		return record, err
+	}
+	cmd, ok := request.(Array)
+	if !ok || len(cmd) == 0 {
+		return record, errors.New("capture: invalid request")
+	}
+	reply, err := reader.readResp(1)
+	if err != nil {
+		return record, err
+	}
+	reader.last += delta
+	record.Time, record.Conn, record.Request, record.Reply = time.Unix(0, reader.last), int64(conn), cmd, reply
+	return record, nil
+}
+
+// Reads a length, less offset, and RESP of that length. Nil if the length
+// is below offset.
+func (reader *CaptureReader) readResp(offset uint64) (Resp, error) {
+	n, err := binary.ReadUvarint(reader.reader)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n < offset {
+		return nil, nil
+	}
+	raw := make([]byte, n-offset)
+	if _, err := io.ReadFull(reader.reader, raw); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return NewReader(bytes.NewReader(raw)).ParseObject()
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// capture records the commands of every client to a file while it runs
+type capture struct {
+	// Checked by every command without taking the lock
+	running int32
+
+	mu      sync.Mutex
+	cfg     CaptureConfig
+	file    *os.File
+	writer  *CaptureWriter
+	records int64
+	stop    chan struct{}
+}
+
+func (capture *capture) active() bool {
+	return atomic.LoadInt32(&capture.running) == 1
+}
+
+// Starts recording to cfg.File, replacing it
+func (capture *capture) start(cfg CaptureConfig) error {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if capture.file != nil {
+		return errors.New("a capture is already running")
+	}
+	if cfg.File == "" {
+		return errors.New("capture.file is not set")
+	}
+	file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer, err := NewCaptureWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	capture.cfg, capture.file, capture.writer, capture.records = cfg, file, writer, 0
+	capture.stop = make(chan struct{})
+	go capture.flush(capture.stop)
+	atomic.StoreInt32(&capture.running, 1)
+	return nil
+}
+
+// Stops recording and returns the number of commands recorded
+func (capture *capture) end() (int64, error) {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if capture.file == nil {
+		return 0, errors.New("no capture is running")
+	}
+	return capture.records, capture.close()
+}
+
+// Call with the lock held
+func (capture *capture) close() error {
+	atomic.StoreInt32(&capture.running, 0)
+	close(capture.stop)
+	err := capture.writer.Flush()
+	if closeErr := capture.file.Close(); err == nil {
+		err = closeErr
+	}
+	capture.file, capture.writer = nil, nil
+	return err
+}
+
+func (capture *capture) flush(stop chan struct{}) {
+	ticker := time.NewTicker(captureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			capture.mu.Lock()
+			if capture.writer != nil {
+				capture.writer.Flush()
+			}
+			capture.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Appends a record, stopping the capture once it fails or reaches
+// capture.max_bytes
+func (capture *capture) record(record CaptureRecord) error {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if capture.file == nil {
+		return nil
+	}
+	if !capture.cfg.Replies {
+		record.Reply = nil
+	}
+	if err := capture.writer.Write(record); err != nil {
+		capture.close()
+		return err
+	}
+	capture.records++
+	if max := capture.cfg.MaxBytes; max > 0 && capture.writer.Size() >= max {
+		if err := capture.close(); err != nil {
+			return err
+		}
+		return errCaptureFull
+	}
+	return nil
+}
+
+// Records the commands sent to the backend while a capture is running, with
+// credentials redacted. Commands rejected by the proxy aren't recorded, and
+// keys are recorded with their namespace, so that replays run what the
+// backend ran.
+func (server *Server) captureCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || !server.capture.active() || strings.EqualFold(cmd[0].String(), "redix") {
+		return next(ctx, cmd)
+	}
+	start := time.Now()
+	reply, err := next(ctx, cmd)
+	if err := server.capture.record(CaptureRecord{Time: start, Conn: proxy.id, Request: redact(cmd), Reply: reply}); err != nil {
+		proxy.Logger.Warn("capture stopped", "error", err)
+	}
+	return reply, err
+}
+
+// REDIX CAPTURE START|STOP
+func (server *Server) captureCommand(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) != 3 {
+		return nil, wrongArgs("redix|capture")
+	}
+	switch strings.ToLower(args[2].String()) {
+	case "start":
+		if err := server.capture.start(server.Configs.Config().Capture); err != nil {
+			return nil, err
+		}
+		return SimpleString("OK"), nil
+	case "stop":
+		records, err := server.capture.end()
+		if err != nil {
+			return nil, err
+		}
+		return Integer(strconv.FormatInt(records, 10)), nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try REDIX HELP.", args[2].String())
+	}
+}
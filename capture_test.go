@@ -0,0 +1,143 @@
+package redix_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Capture", func() {
+	cmd := func(args ...string) redix.Array {
+		var cmd redix.Array
+		for _, arg := range args {
+			cmd = append(cmd, redix.BulkString(arg))
+		}
+		return cmd
+	}
+
+	readAll := func(r io.Reader) []redix.CaptureRecord {
+		reader, err := redix.NewCaptureReader(r)
+		Expect(err).To(BeNil())
+		var records []redix.CaptureRecord
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return records
+			}
+			Expect(err).To(BeNil())
+			records = append(records, record)
+		}
+	}
+
+	It("Should read back the records written.", func() {
+		start := time.Unix(1700000000, 123)
+		records := []redix.CaptureRecord{
+			{Time: start, Conn: 1, Request: cmd("SET", "foo", "bar"), Reply: redix.SimpleString("OK")},
+			{Time: start.Add(-time.Millisecond), Conn: 2, Request: cmd("GET", "foo")},
+			{Time: start.Add(time.Second), Conn: 1, Request: cmd("GET", "nope"), Reply: redix.BulkString(nil)},
+		}
+		var buf bytes.Buffer
+		writer, err := redix.NewCaptureWriter(&buf)
+		Expect(err).To(BeNil())
+		for _, record := range records {
+			Expect(writer.Write(record)).To(Succeed())
+		}
+		Expect(writer.Flush()).To(Succeed())
+		Expect(writer.Size()).To(Equal(int64(buf.Len())))
+
+		Expect(readAll(&buf)).To(Equal(records))
+
+		_, err = redix.NewCaptureReader(bytes.NewBufferString("*1\r\n$4\r\nPING\r\n"))
+		Expect(err).NotTo(BeNil())
+	})
+
+	Context("On a server", func() {
+		var (
+			backend *fakeRedis
+			server  *redix.Server
+			addr    string
+			stop    func()
+			client  *testClient
+			dir     string
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "redix")
+			Expect(err).To(BeNil())
+
+			backend = newFakeRedis()
+			cfg := redix.DefaultConfig()
+			cfg.Backend = backend.URL()
+			cfg.Capture.File = filepath.Join(dir, "redix.capture")
+			cfg.Capture.Replies = true
+			cfg.Commands.Deny = []redix.DenyConfig{{Commands: []string{"flushall"}}}
+			server = redix.NewServer(redix.StaticConfig(cfg))
+
+			addr, stop = startProxy(server)
+			client = dialProxy(addr)
+		})
+
+		AfterEach(func() {
+			client.Close()
+			stop()
+			backend.Close()
+			os.RemoveAll(dir)
+		})
+
+		It("Should record commands between START and STOP.", func() {
+			client.Do("SET", "before", "1")
+			Expect(client.Do("REDIX", "CAPTURE", "START")).To(Equal(redix.SimpleString("OK")))
+			Expect(client.Do("REDIX", "CAPTURE", "START")).To(Equal(redix.Error("ERR a capture is already running")))
+			client.Do("SET", "foo", "bar")
+			client.Do("AUTH", "secret")
+			client.Do("GET", "foo")
+			Expect(client.Do("REDIX", "CAPTURE", "STOP")).To(Equal(redix.Integer("3")))
+			client.Do("SET", "after", "1")
+
+			file, err := os.Open(filepath.Join(dir, "redix.capture"))
+			Expect(err).To(BeNil())
+			defer file.Close()
+			records := readAll(file)
+			Expect(records).To(HaveLen(3))
+			Expect(records[0].Request).To(Equal(cmd("SET", "foo", "bar")))
+			Expect(records[0].Reply).To(Equal(redix.SimpleString("OK")))
+			Expect(records[1].Request).To(Equal(cmd("AUTH", "(redacted)")))
+			Expect(records[2].Request).To(Equal(cmd("GET", "foo")))
+			Expect(records[2].Reply).To(Equal(redix.BulkString("bar")))
+			Expect(records[2].Conn).To(Equal(records[0].Conn))
+		})
+		It("Should record commands as sent to the backend.", func() {
+			tenant, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer tenant.Close()
+			Expect(server.Configs.Update(func(cfg *redix.Config) {
+				cfg.Namespaces.Listeners = map[string]string{tenant.Addr().String(): "a:"}
+			})).To(Succeed())
+			go server.Serve(context.Background(), tenant)
+			namespaced := dialProxy(tenant.Addr().String())
+			defer namespaced.Close()
+
+			Expect(client.Do("REDIX", "CAPTURE", "START")).To(Equal(redix.SimpleString("OK")))
+			Expect(client.Do("FLUSHALL")).To(BeAssignableToTypeOf(redix.Error{}))
+			namespaced.Do("SET", "foo", "bar")
+			Expect(client.Do("REDIX", "CAPTURE", "STOP")).To(Equal(redix.Integer("1")))
+
+			file, err := os.Open(filepath.Join(dir, "redix.capture"))
+			Expect(err).To(BeNil())
+			defer file.Close()
+			records := readAll(file)
+			Expect(records).To(HaveLen(1))
+			Expect(records[0].Request).To(Equal(cmd("SET", "a:foo", "bar")))
+		})
+	})
+})
@@ -0,0 +1,175 @@
+// redix-replay replays a capture recorded by REDIX CAPTURE against a Redis
+// backend. The commands of each captured client are sent in order over a
+// connection of their own.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+)
+
+// Commands that can't be replayed: credentials are redacted from captures,
+// and subscribers don't reply to each command
+var skipped = map[string]bool{
+	"auth": true, "hello": true, "redix": true, "promote": true,
+	"subscribe": true, "psubscribe": true, "ssubscribe": true, "monitor": true,
+}
+
+func main() {
+	target := flag.String("target", "redis://127.0.0.1:6379", "Redis URL of the backend to replay against")
+	speed := flag.Float64("speed", 1, "replay speed, as a multiple of the original. 0 replays as fast as possible")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: redix-replay [flags] capture-file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ip, port, auth, err := redix.ParseRedisURL(*target)
+	if err != nil {
+		slog.Error("Invalid target", "error", err)
+		os.Exit(2)
+	}
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		slog.Error("Error opening capture", "error", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	reader, err := redix.NewCaptureReader(file)
+	if err != nil {
+		slog.Error("Error reading capture", "error", err)
+		os.Exit(1)
+	}
+
+	replayer := &replayer{
+		dialer: &redix.Dialer{IP: ip, Port: port, Auth: auth, Timeout: 5 * time.Second, AuthTimeout: 5 * time.Second},
+		conns:  map[int64]chan redix.CaptureRecord{},
+	}
+	start := time.Now()
+	if err := replayer.run(reader, *speed); err != nil {
+		slog.Error("Error reading capture", "error", err)
+	}
+	slog.Info("Replay done",
+		"duration", time.Since(start),
+		"connections", len(replayer.conns),
+		"commands", replayer.sent,
+		"skipped", replayer.skipped,
+		"errors", replayer.errors,
+		"failed", replayer.failed,
+		"mismatched", replayer.mismatched,
+	)
+}
+
+type replayer struct {
+	dialer *redix.Dialer
+	// The commands of each captured connection, by its id
+	conns map[int64]chan redix.CaptureRecord
+	wg    sync.WaitGroup
+
+	// Commands sent and skipped, error replies, commands lost to a
+	// connection failure, and replies that differ from the captured ones
+	sent, skipped, errors, failed, mismatched int64
+}
+
+// Reads the capture, sending each command once its time has come, and waits
+// for the replies
+func (replayer *replayer) run(reader *redix.CaptureReader, speed float64) error {
+	defer func() {
+		for _, queue := range replayer.conns {
+			close(queue)
+		}
+		replayer.wg.Wait()
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if skipped[strings.ToLower(record.Request[0].String())] {
+			replayer.skipped++
+			continue
+		}
+		if first.IsZero() {
+			first = record.Time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(record.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		queue, ok := replayer.conns[record.Conn]
+		if !ok {
+			queue = make(chan redix.CaptureRecord, 1024)
+			replayer.conns[record.Conn] = queue
+			replayer.wg.Add(1)
+			go replayer.replay(queue)
+		}
+		queue <- record
+	}
+}
+
+// Sends the commands of a connection one at a time. Once the connection
+// fails, the remaining commands fail too: replies may be out of step with
+// the commands, and another connection wouldn't have the same db selected
+// or transaction open.
+func (replayer *replayer) replay(queue chan redix.CaptureRecord) {
+	defer replayer.wg.Done()
+
+	conn, err := replayer.dialer.Dial()
+	if err != nil {
+		slog.Error("Error connecting to target", "error", err)
+		replayer.fail(queue)
+		return
+	}
+	defer conn.Close()
+	reader := redix.NewReader(conn)
+
+	for record := range queue {
+		atomic.AddInt64(&replayer.sent, 1)
+		if _, err := conn.Write(record.Request.Raw()); err != nil {
+			slog.Error("Error sending command", "error", err)
+			atomic.AddInt64(&replayer.failed, 1)
+			replayer.fail(queue)
+			return
+		}
+		reply, err := reader.ParseObject()
+		if err != nil {
+			slog.Error("Error reading reply", "error", err)
+			atomic.AddInt64(&replayer.failed, 1)
+			replayer.fail(queue)
+			return
+		}
+		if _, ok := reply.(redix.Error); ok {
+			atomic.AddInt64(&replayer.errors, 1)
+		}
+		if record.Reply != nil && !bytes.Equal(reply.Raw(), record.Reply.Raw()) {
+			atomic.AddInt64(&replayer.mismatched, 1)
+		}
+	}
+}
+
+// Counts the commands left in the queue as failed
+func (replayer *replayer) fail(queue chan redix.CaptureRecord) {
+	for range queue {
+		atomic.AddInt64(&replayer.failed, 1)
+	}
+}
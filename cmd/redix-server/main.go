@@ -2,11 +2,15 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"flag"
+	"log/slog"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/kevin-cantwell/redix"
 
@@ -14,83 +18,182 @@ import (
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	l, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
+	configPath := flag.String("config", "", "path to a YAML config file. PORT and REDIS_URL are used if empty")
+	flag.Parse()
+
+	var configs *redix.ConfigWatcher
+	if *configPath != "" {
+		var err error
+		configs, err = redix.NewConfigWatcher(*configPath)
+		if err != nil {
+			slog.Error("Error loading config", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		cfg := redix.DefaultConfig()
+		if port := os.Getenv("PORT"); port != "" {
+			cfg.Listen = []string{":" + port}
+		}
+		if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+			cfg.Backend = redisURL
+		}
+		if err := cfg.Validate(); err != nil {
+			slog.Error("Error parsing REDIS_URL", "error", err)
+			os.Exit(1)
+		}
+		configs = redix.StaticConfig(cfg)
 	}
-	defer l.Close()
-	fmt.Println("Listening on " + ":" + port)
 
-	// TODO: source this from writable config file
-	redisURL, err := url.Parse(os.Getenv("REDIS_URL"))
+	server := redix.NewServer(configs)
+	logger := server.Logger
+
+	tracerProvider, err := redix.NewTracerProvider(configs.Config().Tracing)
 	if err != nil {
-		fmt.Println("Error parsing REDIS_URL")
+		logger.Error("Error configuring tracing", "error", err)
 		os.Exit(1)
 	}
+	if tracerProvider != nil {
+		defer tracerProvider.Shutdown(context.Background())
+		server.Tracer = tracerProvider.Tracer("github.com/kevin-cantwell/redix")
+	}
+	configs.OnReload = func(old, cfg *redix.Config) {
+		logger.Info("Config reloaded")
+		server.Reload(old, cfg)
+	}
 
-	ipPort := strings.Split(redisURL.Host, ":")
-	var auth string
-	if redisURL.User != nil {
-		if password, ok := redisURL.User.Password(); ok {
-			auth = password
-		}
+	if *configPath != "" {
+		reloadErrs := make(chan error)
+		go configs.Watch(time.Second, nil, reloadErrs)
+		go func() {
+			for err := range reloadErrs {
+				logger.Error("Error reloading config", "error", err)
+			}
+		}()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := configs.Reload(); err != nil {
+					logger.Error("Error reloading config", "error", err)
+				}
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	if addr := configs.Config().Metrics.Listen; addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.Metrics.Handler())
+		metricsServer = &http.Server{Addr: addr, Handler: mux}
+		go func() {
+			logger.Info("Serving metrics", "addr", addr)
+			// After an upgrade, the old process holds the port until it
+			// starts draining
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				err := metricsServer.ListenAndServe()
+				if errors.Is(err, syscall.EADDRINUSE) && time.Now().Before(deadline) {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				if err != http.ErrServerClosed {
+					logger.Error("Error serving metrics", "error", err)
+				}
+				return
+			}
+		}()
 	}
-	dialer := &redix.Dialer{IP: ipPort[0], Port: ipPort[1], Auth: auth}
-	conns := redix.NewConnectionManager()
 
 	ctx := context.Background()
-	for {
-		// Listen for an incoming connection.
-		clientConn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting client connection: ", err.Error())
-			continue
+	// Listen addresses are ignored when the listeners are inherited
+	listeners, err := redix.InheritedListeners()
+	if err != nil {
+		logger.Error("Error inheriting listeners", "error", err)
+		os.Exit(1)
+	}
+	for _, l := range listeners {
+		defer l.Close()
+		logger.Info("Listening", "addr", l.Addr().String(), "inherited", true)
+	}
+	if len(listeners) == 0 {
+		for _, addr := range configs.Config().Listen {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				logger.Error("Error listening", "error", err)
+				os.Exit(1)
+			}
+			defer l.Close()
+			logger.Info("Listening", "addr", addr)
+			listeners = append(listeners, l)
 		}
-
-		proxy := redix.NewProxy(clientConn, dialer, conns)
-		go handle(ctx, proxy)
 	}
-}
 
-func handle(ctx context.Context, proxy redix.Proxy) {
-	// Make sure to close both client and proxy connections on defer
-	defer proxy.Close()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := server.Serve(ctx, l); err != nil && err != redix.ErrServerClosed {
+				logger.Error("Error accepting client connection", "error", err)
+			}
+		}(l)
+	}
 
-	if err := proxy.Open(); err != nil {
-		return
+	if err := redix.NotifyUpgraded(); err != nil {
+		logger.Error("Error notifying the upgraded process", "error", err)
 	}
 
-	for {
-		array, err := proxy.ParseClientObject()
-		if err != nil {
-			// proxy.Println("client:", err)
-			proxy.WriteClientErr(err)
-			return
-		}
+	served := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(served)
+	}()
 
-		switch strings.ToLower(array[0].String()) {
-		// PROMOTE slaveX auth timeout
-		case "promote":
-			if len(array) < 3 || len(array) > 4 {
-				proxy.WriteClientErr(errors.New("wrong number of arguments for 'promote' command"))
-				return
-			}
-			slaveID, auth, timeout := array[1].String(), "", array[len(array)-1].String()
-			if len(array) == 4 {
-				auth = array[2].String()
-			}
-			if err := proxy.Promote(slaveID, auth, timeout); err != nil {
-				proxy.WriteClientErr(err)
+	upgraded := make(chan struct{}, 1)
+	server.OnUpgrade = func(child *os.Process) {
+		upgraded <- struct{}{}
+	}
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			if _, err := server.Upgrade(); err != nil {
+				logger.Error("Error upgrading", "error", err)
 			}
-			return
-		default:
 		}
+	}()
 
-		if err := proxy.WriteServerObject(array.Raw()); err != nil {
-			proxy.WriteClientErr(err)
-			return
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	var reason string
+	select {
+	case <-served:
+		return
+	case sig := <-term:
+		reason = sig.String()
+	case <-upgraded:
+		reason = "upgrade"
+		// Let the new process bind the metrics port
+		if metricsServer != nil {
+			metricsServer.Close()
 		}
 	}
+
+	drain := time.Duration(configs.Config().Timeouts.Drain)
+	logger.Info("Shutting down", "reason", reason, "drain", drain)
+
+	shutdownCtx := context.Background()
+	if drain > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, drain)
+		defer cancel()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("Closed clients before their commands finished", "error", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	<-served
 }
@@ -0,0 +1,122 @@
+package redix
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// A backend request shared by identical commands
+type coalescedCall struct {
+	done  chan struct{}
+	reply Resp
+	err   error
+}
+
+type coalescer struct {
+	mu       sync.Mutex
+	commands map[string]bool
+	keys     []string
+	calls    map[string]*coalescedCall
+}
+
+func (coalescer *coalescer) configure(cfg CoalesceConfig) {
+	coalescer.mu.Lock()
+	defer coalescer.mu.Unlock()
+
+	coalescer.commands = map[string]bool{}
+	for _, name := range cfg.Commands {
+		coalescer.commands[strings.ToLower(name)] = true
+	}
+	coalescer.keys = cfg.Keys
+	if coalescer.calls == nil {
+		coalescer.calls = map[string]*coalescedCall{}
+	}
+}
+
+// Reports whether the command is coalesced
+func (coalescer *coalescer) applies(name string, cmd Array) bool {
+	coalescer.mu.Lock()
+	defer coalescer.mu.Unlock()
+
+	if !coalescer.commands[name] {
+		return false
+	}
+	if len(coalescer.keys) == 0 {
+		return true
+	}
+	info, _ := lookupCommand(cmd)
+	keys, err := info.Keys(cmd)
+	if err != nil || len(keys) == 0 {
+		return false
+	}
+	for _, key := range keys {
+		matched := false
+		for _, pattern := range coalescer.keys {
+			if globMatch(pattern, key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the call in flight for id, or starts one if there is none, in
+// which case the caller must finish it
+func (coalescer *coalescer) join(id string) (*coalescedCall, bool) {
+	coalescer.mu.Lock()
+	defer coalescer.mu.Unlock()
+
+	if call, ok := coalescer.calls[id]; ok {
+		return call, false
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	coalescer.calls[id] = call
+	return call, true
+}
+
+func (coalescer *coalescer) finish(id string, call *coalescedCall) {
+	coalescer.mu.Lock()
+	delete(coalescer.calls, id)
+	coalescer.mu.Unlock()
+	close(call.done)
+}
+
+// Sends a single request to the backend for identical reads in flight at
+// the same time
+func (server *Server) coalesceReads(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	db, multi := proxy.session()
+	if multi || !server.coalescer.applies(name, cmd) {
+		return next(ctx, cmd)
+	}
+
+	id := commandID(proxy.Backend(), proxy.BackendUser(), db, cmd)
+	call, leader := server.coalescer.join(id)
+	if leader {
+		call.reply, call.err = next(ctx, cmd)
+		server.coalescer.finish(id, call)
+		return call.reply, call.err
+	}
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		// The leader's backend connection failed, which says nothing of this
+		// client's
+		return next(ctx, cmd)
+	}
+	server.Metrics.Coalesced.WithLabelValues(name).Inc()
+	return call.reply, nil
+}
@@ -0,0 +1,81 @@
+package redix_test
+
+import (
+	"strings"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Coalescing", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		clients []*testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Coalesce = redix.CoalesceConfig{Commands: []string{"get"}, Keys: []string{"slow:hot:*"}}
+		server = redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		clients = nil
+		for i := 0; i < 5; i++ {
+			client := dialProxy(addr)
+			Expect(client.Do("PING").String()).To(Equal("PONG"))
+			clients = append(clients, client)
+		}
+	})
+
+	AfterEach(func() {
+		for _, client := range clients {
+			client.Close()
+		}
+		stop()
+		backend.Close()
+	})
+
+	// Sends the command from every client at once, and returns their replies
+	doAll := func(args ...string) []string {
+		var cmd redix.Array
+		for _, arg := range args {
+			cmd = append(cmd, redix.BulkString(arg))
+		}
+		for _, client := range clients {
+			_, err := client.conn.Write(cmd.Raw())
+			Expect(err).To(BeNil())
+		}
+		var replies []string
+		for _, client := range clients {
+			reply, err := client.reader.ParseObject()
+			Expect(err).To(BeNil())
+			replies = append(replies, reply.String())
+		}
+		return replies
+	}
+
+	It("Should send identical reads in flight once.", func() {
+		clients[0].Do("SET", "slow:hot:1", "a")
+		Expect(doAll("GET", "slow:hot:1")).To(Equal(strings.Split("a a a a a", " ")))
+		Expect(backend.Gets()).To(Equal(1))
+		Expect(testutil.ToFloat64(server.Metrics.Coalesced.WithLabelValues("get"))).To(Equal(4.0))
+	})
+	It("Should only coalesce the reads of the same backend user.", func() {
+		clients[0].Do("SET", "slow:hot:1", "a")
+		Expect(clients[1].Do("AUTH", "reader", "r").String()).To(Equal("OK"))
+		Expect(doAll("GET", "slow:hot:1")).To(Equal(strings.Split("a a a a a", " ")))
+		Expect(backend.Gets()).To(Equal(2))
+	})
+	It("Should only coalesce the configured keys.", func() {
+		clients[0].Do("SET", "slow:cold:1", "a")
+		Expect(doAll("GET", "slow:cold:1")).To(Equal(strings.Split("a a a a a", " ")))
+		Expect(backend.Gets()).To(Equal(5))
+	})
+})
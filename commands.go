@@ -0,0 +1,621 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandInfo describes a command the way Redis's COMMAND INFO does
+type CommandInfo struct {
+	Name string
+	// Number of arguments, counting the command name. Negative if it is the
+	// minimum number.
+	Arity int
+	// eg: readonly, write, denyoom, blocking, pubsub, admin, fast, movablekeys
+	Flags []string
+	// Positions of the keys: the first, the last, and the step between them.
+	// A negative LastKey counts from the end of the command.
+	FirstKey, LastKey, Step int
+	// ACL categories, eg: @read, @string, @dangerous
+	Categories []string
+
+	// For movable keys: the position of the argument giving the number of
+	// keys that follow it
+	numkeys int
+	// For movable keys: the keys are the first half of the arguments after
+	// STREAMS
+	streams bool
+	// Redis 7 describes the subcommands of containers such as OBJECT, by
+	// their name after the |
+	subcommands map[string]CommandInfo
+}
+
+// ErrMovableKeys is returned by KeyPositions for commands whose keys can't
+// be located
+var ErrMovableKeys = errors.New("key positions of the command are unknown")
+
+// HasFlag reports whether the command has a flag, eg: readonly
+func (info CommandInfo) HasFlag(flag string) bool {
+	for _, f := range info.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// InCategory reports whether the command is in an ACL category, eg: @write
+func (info CommandInfo) InCategory(category string) bool {
+	for _, c := range info.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (info CommandInfo) ReadOnly() bool { return info.HasFlag("readonly") }
+func (info CommandInfo) Write() bool    { return info.HasFlag("write") }
+func (info CommandInfo) Blocking() bool { return info.HasFlag("blocking") }
+func (info CommandInfo) PubSub() bool   { return info.HasFlag("pubsub") }
+func (info CommandInfo) Admin() bool    { return info.HasFlag("admin") }
+
+// CheckArity reports whether cmd has a valid number of arguments
+func (info CommandInfo) CheckArity(cmd Array) bool {
+	if info.Arity < 0 {
+		return len(cmd) >= -info.Arity
+	}
+	return len(cmd) == info.Arity
+}
+
+// KeyPositions returns the positions of the keys in cmd
+func (info CommandInfo) KeyPositions(cmd Array) ([]int, error) {
+	if len(cmd) > 1 {
+		if sub, found := info.subcommands[strings.ToLower(cmd[1].String())]; found {
+			return sub.KeyPositions(cmd)
+		}
+	}
+	var positions []int
+	if info.Step > 0 {
+		last := info.LastKey
+		if last < 0 {
+			last += len(cmd)
+		}
+		for i := info.FirstKey; i <= last && i < len(cmd); i += info.Step {
+			positions = append(positions, i)
+		}
+	}
+	switch {
+	case info.numkeys > 0:
+		if info.numkeys >= len(cmd) {
+			return nil, wrongArgs(info.Name)
+		}
+		numkeys, err := strconv.Atoi(cmd[info.numkeys].String())
+		if err != nil || numkeys < 0 || info.numkeys+numkeys >= len(cmd) {
+			return nil, errors.New("numkeys should be a positive number of keys")
+		}
+		for i := info.numkeys + 1; i <= info.numkeys+numkeys; i++ {
+			positions = append(positions, i)
+		}
+	case info.streams:
+		for i := 1; i < len(cmd); i++ {
+			if strings.EqualFold(cmd[i].String(), "streams") {
+				n := (len(cmd) - i - 1) / 2
+				for j := i + 1; j <= i+n; j++ {
+					positions = append(positions, j)
+				}
+				break
+			}
+		}
+	case info.HasFlag("movablekeys"):
+		return nil, ErrMovableKeys
+	}
+	return positions, nil
+}
+
+// Keys returns the keys of cmd
+func (info CommandInfo) Keys(cmd Array) ([]string, error) {
+	positions, err := info.KeyPositions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(positions))
+	for i, pos := range positions {
+		keys[i] = cmd[pos].String()
+	}
+	return keys, nil
+}
+
+// Reply renders the command like an entry of COMMAND INFO
+func (info CommandInfo) Reply() Array {
+	flags := Array{}
+	for _, flag := range info.Flags {
+		flags = append(flags, SimpleString(flag))
+	}
+	categories := Array{}
+	for _, category := range info.Categories {
+		categories = append(categories, SimpleString(category))
+	}
+	return Array{
+		BulkString(info.Name),
+		Integer(strconv.Itoa(info.Arity)),
+		flags,
+		Integer(strconv.Itoa(info.FirstKey)),
+		Integer(strconv.Itoa(info.LastKey)),
+		Integer(strconv.Itoa(info.Step)),
+		categories,
+	}
+}
+
+// LookupCommand returns the description of a command, by case-insensitive
+// name. The table is built in, and may be refreshed from the backend (see
+// FeaturesConfig.RefreshCommands).
+func LookupCommand(name string) (CommandInfo, bool) {
+	return commandTable.lookup(name)
+}
+
+// Looks up the command cmd runs, which is the subcommand for containers
+// whose subcommands are known, eg: OBJECT ENCODING
+func lookupCommand(cmd Array) (CommandInfo, bool) {
+	info, ok := LookupCommand(cmd[0].String())
+	if ok && len(cmd) > 1 {
+		if sub, found := info.subcommands[strings.ToLower(cmd[1].String())]; found {
+			return sub, true
+		}
+	}
+	return info, ok
+}
+
+type commandInfos struct {
+	mu       sync.RWMutex
+	commands map[string]CommandInfo
+}
+
+var commandTable = newCommandInfos(builtinCommands)
+
+func newCommandInfos(infos []CommandInfo) *commandInfos {
+	table := &commandInfos{commands: map[string]CommandInfo{}}
+	for _, info := range infos {
+		table.commands[info.Name] = info
+	}
+	return table
+}
+
+func (table *commandInfos) lookup(name string) (CommandInfo, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	info, ok := table.commands[strings.ToLower(name)]
+	return info, ok
+}
+
+// Merges a reply to COMMAND into the table. Movable keys are only located
+// for the commands known to the built-in table.
+func (table *commandInfos) update(reply Array) (int, error) {
+	infos := make([]CommandInfo, 0, len(reply))
+	for _, entry := range reply {
+		info, err := parseCommandInfo(entry)
+		if err != nil {
+			return 0, err
+		}
+		infos = append(infos, info)
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, info := range infos {
+		if known, ok := table.commands[info.Name]; ok {
+			info.numkeys, info.streams = known.numkeys, known.streams
+			// Containers are only described by their subcommands, so the
+			// built-in entry is kept for those missing from them
+			if info.subcommands != nil {
+				known.subcommands = info.subcommands
+				info = known
+			}
+		}
+		table.commands[info.Name] = info
+	}
+	return len(infos), nil
+}
+
+func parseCommandInfo(entry Resp) (CommandInfo, error) {
+	fields, ok := entry.(Array)
+	if !ok || len(fields) < 6 {
+		return CommandInfo{}, errors.New("invalid COMMAND reply")
+	}
+	var ints [4]int
+	for i, field := range []Resp{fields[1], fields[3], fields[4], fields[5]} {
+		n, err := strconv.Atoi(field.String())
+		if err != nil {
+			return CommandInfo{}, fmt.Errorf("invalid COMMAND reply: %v", err)
+		}
+		ints[i] = n
+	}
+	info := CommandInfo{
+		Name:     strings.ToLower(fields[0].String()),
+		Arity:    ints[0],
+		FirstKey: ints[1],
+		LastKey:  ints[2],
+		Step:     ints[3],
+	}
+	if flags, ok := fields[2].(Array); ok {
+		for _, flag := range flags {
+			info.Flags = append(info.Flags, flag.String())
+		}
+	}
+	// Redis 6 added ACL categories
+	if len(fields) > 6 {
+		if categories, ok := fields[6].(Array); ok {
+			for _, category := range categories {
+				info.Categories = append(info.Categories, category.String())
+			}
+		}
+	}
+	// Redis 7 added subcommands
+	if len(fields) > 9 {
+		subs, _ := fields[9].(Array)
+		for _, entry := range subs {
+			sub, err := parseCommandInfo(entry)
+			if err != nil {
+				return CommandInfo{}, err
+			}
+			if info.subcommands == nil {
+				info.subcommands = map[string]CommandInfo{}
+			}
+			info.subcommands[strings.TrimPrefix(sub.Name, info.Name+"|")] = sub
+		}
+	}
+	return info, nil
+}
+
+// Time allowed for the backend to reply to COMMAND
+const commandRefreshTimeout = 5 * time.Second
+
+// Refreshes the command table from the backend the first time a client
+// connects to it
+func (server *Server) refreshCommands(cfg *Config) {
+	if !cfg.Features.RefreshCommands {
+		return
+	}
+	addr := server.Dialer.Addr()
+	server.mu.Lock()
+	if server.commandsFrom == addr {
+		server.mu.Unlock()
+		return
+	}
+	server.commandsFrom = addr
+	server.mu.Unlock()
+
+	go func() {
+		n, err := server.fetchCommands()
+		if err != nil {
+			server.Logger.Warn("failed to refresh the command table", "backend", addr, "error", err)
+			// Let the next client retry
+			server.mu.Lock()
+			if server.commandsFrom == addr {
+				server.commandsFrom = ""
+			}
+			server.mu.Unlock()
+			return
+		}
+		server.Logger.Info("refreshed the command table", "backend", addr, "commands", n)
+	}()
+}
+
+func (server *Server) fetchCommands() (int, error) {
+	conn, err := server.Dialer.Dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(commandRefreshTimeout))
+	if _, err := conn.Write(Array{BulkString("COMMAND")}.Raw()); err != nil {
+		return 0, err
+	}
+	reply, err := NewReader(conn).ParseObject()
+	if err != nil {
+		return 0, err
+	}
+	switch reply := reply.(type) {
+	case Array:
+		return commandTable.update(reply)
+	case Error:
+		return 0, errors.New(reply.String())
+	default:
+		return 0, errors.New("invalid COMMAND reply")
+	}
+}
+
+// Builds a CommandInfo. The categories implied by the flags are added to
+// the given ones.
+func command(name string, arity int, flags string, first, last, step int, categories string) CommandInfo {
+	info := CommandInfo{
+		Name:     name,
+		Arity:    arity,
+		Flags:    strings.Fields(flags),
+		FirstKey: first,
+		LastKey:  last,
+		Step:     step,
+	}
+	if info.Write() {
+		info.Categories = append(info.Categories, "@write")
+	}
+	if info.ReadOnly() {
+		info.Categories = append(info.Categories, "@read")
+	}
+	info.Categories = append(info.Categories, strings.Fields(categories)...)
+	if info.Admin() {
+		info.Categories = append(info.Categories, "@admin", "@dangerous")
+	}
+	if info.HasFlag("fast") {
+		info.Categories = append(info.Categories, "@fast")
+	} else {
+		info.Categories = append(info.Categories, "@slow")
+	}
+	if info.Blocking() {
+		info.Categories = append(info.Categories, "@blocking")
+	}
+	return info
+}
+
+func withNumkeys(info CommandInfo, numkeys int) CommandInfo {
+	info.numkeys = numkeys
+	return info
+}
+
+func withStreams(info CommandInfo) CommandInfo {
+	info.streams = true
+	return info
+}
+
+// As reported by COMMAND INFO on Redis 7. Commands with subcommands, such as
+// CONFIG, are described by their container.
+var builtinCommands = []CommandInfo{
+	// Connection
+	command("ping", -1, "fast", 0, 0, 0, "@connection"),
+	command("echo", 2, "fast", 0, 0, 0, "@connection"),
+	command("select", 2, "loading stale fast", 0, 0, 0, "@connection"),
+	command("hello", -1, "noscript loading stale fast no_auth", 0, 0, 0, "@connection"),
+	command("auth", -2, "noscript loading stale fast no_auth", 0, 0, 0, "@connection"),
+	command("quit", -1, "noscript loading stale fast no_auth", 0, 0, 0, "@connection"),
+	command("client", -2, "", 0, 0, 0, "@connection"),
+	command("command", -1, "loading stale", 0, 0, 0, "@connection"),
+	command("readonly", 1, "loading stale fast", 0, 0, 0, "@connection"),
+	command("readwrite", 1, "loading stale fast", 0, 0, 0, "@connection"),
+	command("wait", 3, "noscript", 0, 0, 0, "@connection"),
+	command("waitaof", 4, "noscript", 0, 0, 0, "@connection"),
+
+	// Server
+	command("info", -1, "loading stale", 0, 0, 0, "@dangerous"),
+	command("time", 1, "loading stale fast", 0, 0, 0, ""),
+	command("config", -2, "admin noscript loading stale", 0, 0, 0, ""),
+	command("debug", -2, "admin noscript loading stale", 0, 0, 0, ""),
+	command("monitor", 1, "admin noscript loading stale", 0, 0, 0, ""),
+	command("shutdown", -1, "admin noscript loading stale no_multi allow_busy", 0, 0, 0, ""),
+	command("save", 1, "admin noscript no_async_loading no_multi", 0, 0, 0, ""),
+	command("bgsave", -1, "admin noscript no_async_loading", 0, 0, 0, ""),
+	command("bgrewriteaof", 1, "admin noscript no_async_loading", 0, 0, 0, ""),
+	command("lastsave", 1, "loading stale fast", 0, 0, 0, "@admin @dangerous"),
+	command("replicaof", 3, "admin noscript stale no_async_loading", 0, 0, 0, ""),
+	command("slaveof", 3, "admin noscript stale no_async_loading", 0, 0, 0, ""),
+	command("slowlog", -2, "admin loading stale", 0, 0, 0, ""),
+
+	// Generic
+	command("del", -2, "write", 1, -1, 1, "@keyspace"),
+	command("unlink", -2, "write fast", 1, -1, 1, "@keyspace"),
+	command("exists", -2, "readonly fast", 1, -1, 1, "@keyspace"),
+	command("touch", -2, "readonly fast", 1, -1, 1, "@keyspace"),
+	command("type", 2, "readonly fast", 1, 1, 1, "@keyspace"),
+	command("expire", -3, "write fast", 1, 1, 1, "@keyspace"),
+	command("pexpire", -3, "write fast", 1, 1, 1, "@keyspace"),
+	command("expireat", -3, "write fast", 1, 1, 1, "@keyspace"),
+	command("pexpireat", -3, "write fast", 1, 1, 1, "@keyspace"),
+	command("expiretime", 2, "readonly fast", 1, 1, 1, "@keyspace"),
+	command("pexpiretime", 2, "readonly fast", 1, 1, 1, "@keyspace"),
+	command("ttl", 2, "readonly fast", 1, 1, 1, "@keyspace"),
+	command("pttl", 2, "readonly fast", 1, 1, 1, "@keyspace"),
+	command("persist", 2, "write fast", 1, 1, 1, "@keyspace"),
+	command("dump", 2, "readonly", 1, 1, 1, "@keyspace"),
+	command("restore", -4, "write denyoom", 1, 1, 1, "@keyspace @dangerous"),
+	command("rename", 3, "write", 1, 2, 1, "@keyspace"),
+	command("renamenx", 3, "write fast", 1, 2, 1, "@keyspace"),
+	command("copy", -3, "write denyoom", 1, 2, 1, "@keyspace"),
+	command("move", 3, "write fast", 1, 1, 1, "@keyspace"),
+	command("keys", 2, "readonly", 0, 0, 0, "@keyspace @dangerous"),
+	command("scan", -2, "readonly", 0, 0, 0, "@keyspace"),
+	command("randomkey", 1, "readonly", 0, 0, 0, "@keyspace"),
+	command("dbsize", 1, "readonly fast", 0, 0, 0, "@keyspace"),
+	command("flushall", -1, "write", 0, 0, 0, "@keyspace @dangerous"),
+	command("flushdb", -1, "write", 0, 0, 0, "@keyspace @dangerous"),
+	command("swapdb", 3, "write fast", 0, 0, 0, "@keyspace @dangerous"),
+	command("sort", -2, "write denyoom movablekeys", 1, 1, 1, "@set @sortedset @list @dangerous"),
+	command("sort_ro", -2, "readonly movablekeys", 1, 1, 1, "@set @sortedset @list @dangerous"),
+	command("migrate", -6, "write movablekeys", 3, 3, 1, "@keyspace @dangerous"),
+
+	// Strings
+	command("get", 2, "readonly fast", 1, 1, 1, "@string"),
+	command("set", -3, "write denyoom", 1, 1, 1, "@string"),
+	command("setnx", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("setex", 4, "write denyoom", 1, 1, 1, "@string"),
+	command("psetex", 4, "write denyoom", 1, 1, 1, "@string"),
+	command("getset", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("getdel", 2, "write fast", 1, 1, 1, "@string"),
+	command("getex", -2, "write fast", 1, 1, 1, "@string"),
+	command("append", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("strlen", 2, "readonly fast", 1, 1, 1, "@string"),
+	command("incr", 2, "write denyoom fast", 1, 1, 1, "@string"),
+	command("decr", 2, "write denyoom fast", 1, 1, 1, "@string"),
+	command("incrby", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("decrby", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("incrbyfloat", 3, "write denyoom fast", 1, 1, 1, "@string"),
+	command("getrange", 4, "readonly", 1, 1, 1, "@string"),
+	command("setrange", 4, "write denyoom", 1, 1, 1, "@string"),
+	command("substr", 4, "readonly", 1, 1, 1, "@string"),
+	command("mget", -2, "readonly fast", 1, -1, 1, "@string"),
+	command("mset", -3, "write denyoom", 1, -1, 2, "@string"),
+	command("msetnx", -3, "write denyoom", 1, -1, 2, "@string"),
+	command("lcs", -3, "readonly", 1, 2, 1, "@string"),
+
+	// Bitmaps
+	command("getbit", 3, "readonly fast", 1, 1, 1, "@bitmap"),
+	command("setbit", 4, "write denyoom", 1, 1, 1, "@bitmap"),
+	command("bitcount", -2, "readonly", 1, 1, 1, "@bitmap"),
+	command("bitpos", -3, "readonly", 1, 1, 1, "@bitmap"),
+	command("bitfield", -2, "write denyoom", 1, 1, 1, "@bitmap"),
+	command("bitfield_ro", -2, "readonly fast", 1, 1, 1, "@bitmap"),
+	command("bitop", -4, "write denyoom", 2, -1, 1, "@bitmap"),
+
+	// Hashes
+	command("hget", 3, "readonly fast", 1, 1, 1, "@hash"),
+	command("hset", -4, "write denyoom fast", 1, 1, 1, "@hash"),
+	command("hsetnx", 4, "write denyoom fast", 1, 1, 1, "@hash"),
+	command("hmset", -4, "write denyoom fast", 1, 1, 1, "@hash"),
+	command("hmget", -3, "readonly fast", 1, 1, 1, "@hash"),
+	command("hdel", -3, "write fast", 1, 1, 1, "@hash"),
+	command("hlen", 2, "readonly fast", 1, 1, 1, "@hash"),
+	command("hstrlen", 3, "readonly fast", 1, 1, 1, "@hash"),
+	command("hkeys", 2, "readonly", 1, 1, 1, "@hash"),
+	command("hvals", 2, "readonly", 1, 1, 1, "@hash"),
+	command("hgetall", 2, "readonly", 1, 1, 1, "@hash"),
+	command("hexists", 3, "readonly fast", 1, 1, 1, "@hash"),
+	command("hincrby", 4, "write denyoom fast", 1, 1, 1, "@hash"),
+	command("hincrbyfloat", 4, "write denyoom fast", 1, 1, 1, "@hash"),
+	command("hrandfield", -2, "readonly", 1, 1, 1, "@hash"),
+	command("hscan", -3, "readonly", 1, 1, 1, "@hash"),
+
+	// Lists
+	command("lpush", -3, "write denyoom fast", 1, 1, 1, "@list"),
+	command("rpush", -3, "write denyoom fast", 1, 1, 1, "@list"),
+	command("lpushx", -3, "write denyoom fast", 1, 1, 1, "@list"),
+	command("rpushx", -3, "write denyoom fast", 1, 1, 1, "@list"),
+	command("lpop", -2, "write fast", 1, 1, 1, "@list"),
+	command("rpop", -2, "write fast", 1, 1, 1, "@list"),
+	command("llen", 2, "readonly fast", 1, 1, 1, "@list"),
+	command("lrange", 4, "readonly", 1, 1, 1, "@list"),
+	command("lindex", 3, "readonly", 1, 1, 1, "@list"),
+	command("lset", 4, "write denyoom", 1, 1, 1, "@list"),
+	command("linsert", 5, "write denyoom", 1, 1, 1, "@list"),
+	command("lrem", 4, "write", 1, 1, 1, "@list"),
+	command("ltrim", 4, "write", 1, 1, 1, "@list"),
+	command("lpos", -3, "readonly", 1, 1, 1, "@list"),
+	command("rpoplpush", 3, "write denyoom", 1, 2, 1, "@list"),
+	command("lmove", 5, "write denyoom", 1, 2, 1, "@list"),
+	command("blpop", -3, "write noscript blocking", 1, -2, 1, "@list"),
+	command("brpop", -3, "write noscript blocking", 1, -2, 1, "@list"),
+	command("brpoplpush", 4, "write denyoom noscript blocking", 1, 2, 1, "@list"),
+	command("blmove", 6, "write denyoom noscript blocking", 1, 2, 1, "@list"),
+	withNumkeys(command("lmpop", -4, "write movablekeys", 0, 0, 0, "@list"), 1),
+	withNumkeys(command("blmpop", -5, "write blocking movablekeys", 0, 0, 0, "@list"), 2),
+
+	// Sets
+	command("sadd", -3, "write denyoom fast", 1, 1, 1, "@set"),
+	command("srem", -3, "write fast", 1, 1, 1, "@set"),
+	command("scard", 2, "readonly fast", 1, 1, 1, "@set"),
+	command("smembers", 2, "readonly", 1, 1, 1, "@set"),
+	command("sismember", 3, "readonly fast", 1, 1, 1, "@set"),
+	command("smismember", -3, "readonly fast", 1, 1, 1, "@set"),
+	command("spop", -2, "write fast", 1, 1, 1, "@set"),
+	command("srandmember", -2, "readonly", 1, 1, 1, "@set"),
+	command("sscan", -3, "readonly", 1, 1, 1, "@set"),
+	command("smove", 4, "write fast", 1, 2, 1, "@set"),
+	command("sinter", -2, "readonly", 1, -1, 1, "@set"),
+	command("sunion", -2, "readonly", 1, -1, 1, "@set"),
+	command("sdiff", -2, "readonly", 1, -1, 1, "@set"),
+	command("sinterstore", -3, "write denyoom", 1, -1, 1, "@set"),
+	command("sunionstore", -3, "write denyoom", 1, -1, 1, "@set"),
+	command("sdiffstore", -3, "write denyoom", 1, -1, 1, "@set"),
+	withNumkeys(command("sintercard", -3, "readonly movablekeys", 0, 0, 0, "@set"), 1),
+
+	// Sorted sets
+	command("zadd", -4, "write denyoom fast", 1, 1, 1, "@sortedset"),
+	command("zrem", -3, "write fast", 1, 1, 1, "@sortedset"),
+	command("zcard", 2, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zcount", 4, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zincrby", 4, "write denyoom fast", 1, 1, 1, "@sortedset"),
+	command("zscore", 3, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zmscore", -3, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zrank", -3, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zrevrank", -3, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zrange", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrevrange", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrangebyscore", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrevrangebyscore", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrangebylex", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrevrangebylex", -4, "readonly", 1, 1, 1, "@sortedset"),
+	command("zlexcount", 4, "readonly fast", 1, 1, 1, "@sortedset"),
+	command("zremrangebyrank", 4, "write", 1, 1, 1, "@sortedset"),
+	command("zremrangebyscore", 4, "write", 1, 1, 1, "@sortedset"),
+	command("zremrangebylex", 4, "write", 1, 1, 1, "@sortedset"),
+	command("zpopmin", -2, "write fast", 1, 1, 1, "@sortedset"),
+	command("zpopmax", -2, "write fast", 1, 1, 1, "@sortedset"),
+	command("zrandmember", -2, "readonly", 1, 1, 1, "@sortedset"),
+	command("zscan", -3, "readonly", 1, 1, 1, "@sortedset"),
+	command("zrangestore", -5, "write denyoom", 1, 2, 1, "@sortedset"),
+	command("bzpopmin", -3, "write noscript blocking fast", 1, -2, 1, "@sortedset"),
+	command("bzpopmax", -3, "write noscript blocking fast", 1, -2, 1, "@sortedset"),
+	withNumkeys(command("zunion", -3, "readonly movablekeys", 0, 0, 0, "@sortedset"), 1),
+	withNumkeys(command("zinter", -3, "readonly movablekeys", 0, 0, 0, "@sortedset"), 1),
+	withNumkeys(command("zdiff", -3, "readonly movablekeys", 0, 0, 0, "@sortedset"), 1),
+	withNumkeys(command("zintercard", -3, "readonly movablekeys", 0, 0, 0, "@sortedset"), 1),
+	withNumkeys(command("zunionstore", -4, "write denyoom movablekeys", 1, 1, 1, "@sortedset"), 2),
+	withNumkeys(command("zinterstore", -4, "write denyoom movablekeys", 1, 1, 1, "@sortedset"), 2),
+	withNumkeys(command("zdiffstore", -4, "write denyoom movablekeys", 1, 1, 1, "@sortedset"), 2),
+	withNumkeys(command("zmpop", -4, "write movablekeys", 0, 0, 0, "@sortedset"), 1),
+	withNumkeys(command("bzmpop", -5, "write blocking movablekeys", 0, 0, 0, "@sortedset"), 2),
+
+	// Streams
+	command("xadd", -5, "write denyoom fast", 1, 1, 1, "@stream"),
+	command("xlen", 2, "readonly fast", 1, 1, 1, "@stream"),
+	command("xrange", -4, "readonly", 1, 1, 1, "@stream"),
+	command("xrevrange", -4, "readonly", 1, 1, 1, "@stream"),
+	command("xdel", -3, "write fast", 1, 1, 1, "@stream"),
+	command("xtrim", -4, "write", 1, 1, 1, "@stream"),
+	command("xack", -4, "write fast", 1, 1, 1, "@stream"),
+	command("xpending", -3, "readonly", 1, 1, 1, "@stream"),
+	command("xclaim", -6, "write fast", 1, 1, 1, "@stream"),
+	command("xautoclaim", -6, "write fast", 1, 1, 1, "@stream"),
+	command("xsetid", -3, "write denyoom fast", 1, 1, 1, "@stream"),
+	withStreams(command("xread", -4, "readonly blocking movablekeys", 0, 0, 0, "@stream")),
+	withStreams(command("xreadgroup", -7, "write blocking movablekeys", 0, 0, 0, "@stream")),
+
+	// HyperLogLogs
+	command("pfadd", -2, "write denyoom fast", 1, 1, 1, "@hyperloglog"),
+	command("pfcount", -2, "readonly", 1, -1, 1, "@hyperloglog"),
+	command("pfmerge", -2, "write denyoom", 1, -1, 1, "@hyperloglog"),
+
+	// Geo
+	command("geoadd", -5, "write denyoom", 1, 1, 1, "@geo"),
+	command("geodist", -4, "readonly", 1, 1, 1, "@geo"),
+	command("geohash", -2, "readonly", 1, 1, 1, "@geo"),
+	command("geopos", -2, "readonly", 1, 1, 1, "@geo"),
+	command("geosearch", -7, "readonly", 1, 1, 1, "@geo"),
+	command("geosearchstore", -8, "write denyoom", 1, 2, 1, "@geo"),
+
+	// Pub/sub
+	command("publish", 3, "pubsub loading stale fast may_replicate", 0, 0, 0, "@pubsub"),
+	command("subscribe", -2, "pubsub noscript loading stale", 0, 0, 0, "@pubsub"),
+	command("unsubscribe", -1, "pubsub noscript loading stale", 0, 0, 0, "@pubsub"),
+	command("psubscribe", -2, "pubsub noscript loading stale", 0, 0, 0, "@pubsub"),
+	command("punsubscribe", -1, "pubsub noscript loading stale", 0, 0, 0, "@pubsub"),
+	command("pubsub", -2, "", 0, 0, 0, "@pubsub"),
+
+	// Transactions
+	command("multi", 1, "noscript loading stale fast allow_busy", 0, 0, 0, "@transaction"),
+	command("exec", 1, "noscript loading stale skip_slowlog", 0, 0, 0, "@transaction"),
+	command("discard", 1, "noscript loading stale fast allow_busy", 0, 0, 0, "@transaction"),
+	command("watch", -2, "noscript loading stale fast allow_busy", 1, -1, 1, "@transaction"),
+	command("unwatch", 1, "noscript loading stale fast allow_busy", 0, 0, 0, "@transaction"),
+
+	// Scripting
+	withNumkeys(command("eval", -3, "noscript stale skip_monitor may_replicate no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	withNumkeys(command("evalsha", -3, "noscript stale skip_monitor may_replicate no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	withNumkeys(command("eval_ro", -3, "readonly noscript stale skip_monitor no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	withNumkeys(command("evalsha_ro", -3, "readonly noscript stale skip_monitor no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	withNumkeys(command("fcall", -3, "noscript stale skip_monitor may_replicate no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	withNumkeys(command("fcall_ro", -3, "readonly noscript stale skip_monitor no_mandatory_keys movablekeys", 0, 0, 0, "@scripting"), 2),
+	command("script", -2, "", 0, 0, 0, "@scripting"),
+	command("function", -2, "", 0, 0, 0, "@scripting"),
+}
@@ -0,0 +1,125 @@
+package redix_test
+
+import (
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func args(words ...string) redix.Array {
+	cmd := redix.Array{}
+	for _, word := range words {
+		cmd = append(cmd, redix.BulkString(word))
+	}
+	return cmd
+}
+
+var _ = Describe("Command table", func() {
+	It("Should describe commands.", func() {
+		info, ok := redix.LookupCommand("GET")
+		Expect(ok).To(BeTrue())
+		Expect(info.Arity).To(Equal(2))
+		Expect(info.ReadOnly()).To(BeTrue())
+		Expect(info.Write()).To(BeFalse())
+		Expect(info.InCategory("@string")).To(BeTrue())
+		Expect(info.CheckArity(args("get", "foo"))).To(BeTrue())
+		Expect(info.CheckArity(args("get"))).To(BeFalse())
+
+		info, _ = redix.LookupCommand("blpop")
+		Expect(info.Blocking()).To(BeTrue())
+		Expect(info.InCategory("@blocking")).To(BeTrue())
+
+		info, _ = redix.LookupCommand("flushall")
+		Expect(info.InCategory("@dangerous")).To(BeTrue())
+
+		_, ok = redix.LookupCommand("nosuchcommand")
+		Expect(ok).To(BeFalse())
+	})
+	It("Should find keys.", func() {
+		keys := func(words ...string) []string {
+			info, ok := redix.LookupCommand(words[0])
+			Expect(ok).To(BeTrue())
+			keys, err := info.Keys(args(words...))
+			Expect(err).To(BeNil())
+			return keys
+		}
+		Expect(keys("set", "a", "1")).To(Equal([]string{"a"}))
+		Expect(keys("mset", "a", "1", "b", "2")).To(Equal([]string{"a", "b"}))
+		Expect(keys("blpop", "a", "b", "0")).To(Equal([]string{"a", "b"}))
+		Expect(keys("bitop", "and", "dest", "a")).To(Equal([]string{"dest", "a"}))
+		Expect(keys("zunionstore", "dest", "2", "a", "b", "weights", "1", "2")).To(Equal([]string{"dest", "a", "b"}))
+		Expect(keys("eval", "return 1", "1", "a", "arg")).To(Equal([]string{"a"}))
+		Expect(keys("eval", "return 1", "0")).To(BeEmpty())
+		Expect(keys("blmpop", "0", "2", "a", "b", "left")).To(Equal([]string{"a", "b"}))
+		Expect(keys("xread", "count", "1", "streams", "a", "b", "0", "0")).To(Equal([]string{"a", "b"}))
+		Expect(keys("ping")).To(BeEmpty())
+
+		info, _ := redix.LookupCommand("eval")
+		_, err := info.Keys(args("eval", "return 1", "3", "a"))
+		Expect(err).NotTo(BeNil())
+		info, _ = redix.LookupCommand("sort")
+		_, err = info.Keys(args("sort", "a", "store", "b"))
+		Expect(err).To(Equal(redix.ErrMovableKeys))
+	})
+
+	Context("Through the proxy", func() {
+		var (
+			backend *fakeRedis
+			addr    string
+			stop    func()
+			client  *testClient
+		)
+
+		BeforeEach(func() {
+			backend = newFakeRedis()
+			cfg := redix.DefaultConfig()
+			cfg.Backend = backend.URL()
+			cfg.Features.RefreshCommands = true
+			server := redix.NewServer(redix.StaticConfig(cfg))
+
+			addr, stop = startProxy(server)
+			client = dialProxy(addr)
+		})
+
+		AfterEach(func() {
+			client.Close()
+			stop()
+			backend.Close()
+		})
+
+		It("Should reply to REDIX COMMAND INFO.", func() {
+			Expect(client.Do("REDIX", "COMMAND", "INFO", "get", "nosuchcommand").String()).
+				To(Equal("[[get 2 [readonly fast] 1 1 1 [@read @string @fast]] []]"))
+		})
+		It("Should refresh the table from the backend.", func() {
+			Expect(client.Do("PING").String()).To(Equal("PONG"))
+			Eventually(func() bool {
+				_, ok := redix.LookupCommand("frob.get")
+				return ok
+			}).Should(BeTrue())
+
+			info, _ := redix.LookupCommand("frob.get")
+			Expect(info.ReadOnly()).To(BeTrue())
+			// Movable keys are still located for known commands
+			info, _ = redix.LookupCommand("zunionstore")
+			keys, err := info.Keys(args("zunionstore", "dest", "1", "a"))
+			Expect(err).To(BeNil())
+			Expect(keys).To(Equal([]string{"dest", "a"}))
+		})
+		It("Should locate the keys of subcommands.", func() {
+			Expect(client.Do("PING").String()).To(Equal("PONG"))
+			Eventually(func() bool {
+				_, ok := redix.LookupCommand("object")
+				return ok
+			}).Should(BeTrue())
+
+			info, _ := redix.LookupCommand("object")
+			keys, err := info.Keys(args("object", "encoding", "foo"))
+			Expect(err).To(BeNil())
+			Expect(keys).To(Equal([]string{"foo"}))
+			// Built-in containers keep their flags
+			info, _ = redix.LookupCommand("config")
+			Expect(info.Admin()).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,144 @@
+package redix
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// CommandStat counts the calls of a command as seen by the proxy
+type CommandStat struct {
+	// Calls run, including those with an error reply, which also count as
+	// failed. Calls rejected by the proxy before reaching the backend, eg:
+	// by a command rule or rate limit, only count as rejected.
+	Calls, Failed, Rejected int64
+	// From the command entering the proxy to its reply
+	Duration, MaxDuration time.Duration
+	// Sizes of the requests and replies, in RESP
+	BytesIn, BytesOut int64
+}
+
+// commandStats keeps a CommandStat per command name
+type commandStats struct {
+	mu    sync.Mutex
+	stats map[string]*CommandStat
+}
+
+func (stats *commandStats) add(name string, duration time.Duration, in, out int64, failed, rejected bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.stats == nil {
+		stats.stats = map[string]*CommandStat{}
+	}
+	stat, ok := stats.stats[name]
+	if !ok {
+		stat = &CommandStat{}
+		stats.stats[name] = stat
+	}
+	stat.BytesIn += in
+	stat.BytesOut += out
+	if rejected {
+		stat.Rejected++
+		return
+	}
+	stat.Calls++
+	if failed {
+		stat.Failed++
+	}
+	stat.Duration += duration
+	if duration > stat.MaxDuration {
+		stat.MaxDuration = duration
+	}
+}
+
+func (stats *commandStats) get() map[string]CommandStat {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	copied := make(map[string]CommandStat, len(stats.stats))
+	for name, stat := range stats.stats {
+		copied[name] = *stat
+	}
+	return copied
+}
+
+func (stats *commandStats) reset() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.stats = nil
+}
+
+// Renders the stats as Redis's INFO commandstats, with the max latency and
+// sizes added
+func (stats *commandStats) info() string {
+	all := stats.get()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"# Commandstats"}
+	for _, name := range names {
+		stat := all[name]
+		usec := stat.Duration.Microseconds()
+		perCall := 0.0
+		if stat.Calls > 0 {
+			perCall = float64(usec) / float64(stat.Calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d,max_usec=%d,bytes_in=%d,bytes_out=%d",
+			name, stat.Calls, usec, perCall, stat.Rejected, stat.Failed, stat.MaxDuration.Microseconds(), stat.BytesIn, stat.BytesOut))
+	}
+	return strings.Join(append(lines, ""), "\r\n")
+}
+
+// CommandStats returns the stats of each command name since the server
+// started or they were reset
+func (server *Server) CommandStats() map[string]CommandStat {
+	return server.cmdStats.get()
+}
+
+// Counts calls, failures and rejections per command, along with their
+// latency and sizes
+func (server *Server) countCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	proxy.passed = false
+	start := time.Now()
+	reply, err := next(ctx, cmd)
+	duration := time.Since(start)
+
+	_, failed := reply.(Error)
+	failed = failed || err != nil && err != ErrCloseClient
+	server.cmdStats.add(commandLabel(cmd), duration, respSize(cmd), respSize(reply), failed && proxy.passed, failed && !proxy.passed)
+	return reply, err
+}
+
+// Marks commands as having passed the interceptors that reject them, so
+// that countCommands tells failed commands from rejected ones
+func (server *Server) passCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	if proxy, ok := ProxyFromContext(ctx); ok {
+		proxy.passed = true
+	}
+	return next(ctx, cmd)
+}
+
+// REDIX COMMANDSTATS [RESET]
+func (server *Server) commandStatsCommand(proxy *Proxy, args Array) (Resp, error) {
+	switch {
+	case len(args) == 2:
+		return BulkString(server.cmdStats.info()), nil
+	case len(args) == 3 && strings.EqualFold(args[2].String(), "reset"):
+		server.cmdStats.reset()
+		return SimpleString("OK"), nil
+	default:
+		return nil, wrongArgs("redix|commandstats")
+	}
+}
@@ -0,0 +1,66 @@
+package redix_test
+
+import (
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command stats", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Commands.Deny = []redix.DenyConfig{{Commands: []string{"flushall"}}}
+		server = redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	stats := func() string {
+		return client.Do("REDIX", "COMMANDSTATS").String()
+	}
+
+	It("Should count calls, failures and rejections.", func() {
+		client.Do("SET", "foo", "1")
+		client.Do("GET", "foo")
+		client.Do("GET", "bar")
+		// Denied by the proxy
+		client.Do("FLUSHALL")
+		// Unknown to the backend
+		client.Do("LPUSH", "list", "a")
+
+		Expect(stats()).To(HavePrefix("# Commandstats\r\n"))
+		Expect(stats()).To(MatchRegexp(`cmdstat_get:calls=2,usec=\d+,usec_per_call=\d+\.\d\d,rejected_calls=0,failed_calls=0,max_usec=\d+,bytes_in=\d+,bytes_out=\d+\r\n`))
+		Expect(stats()).To(MatchRegexp(`cmdstat_flushall:calls=0,usec=0,usec_per_call=0\.00,rejected_calls=1,failed_calls=0,`))
+		Expect(stats()).To(MatchRegexp(`cmdstat_lpush:calls=1,usec=\d+,usec_per_call=\d+\.\d\d,rejected_calls=0,failed_calls=1,`))
+
+		set := server.CommandStats()["set"]
+		Expect(set.Calls).To(Equal(int64(1)))
+		Expect(set.BytesIn).To(Equal(int64(len(redix.Array{redix.BulkString("SET"), redix.BulkString("foo"), redix.BulkString("1")}.Raw()))))
+		Expect(set.BytesOut).To(Equal(int64(len("+OK\r\n"))))
+		Expect(set.MaxDuration).To(BeNumerically(">", 0))
+		Expect(set.Duration).To(BeNumerically(">=", set.MaxDuration))
+	})
+
+	It("Should reset the stats.", func() {
+		client.Do("GET", "foo")
+		Expect(client.Do("REDIX", "COMMANDSTATS", "RESET")).To(Equal(redix.SimpleString("OK")))
+		Expect(server.CommandStats()).NotTo(HaveKey("get"))
+	})
+})
@@ -0,0 +1,942 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Duration is a time.Duration that reads and writes itself as a
+// human readable string (eg: "1.5s") in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// Config is the proxy configuration as read from a YAML file.
+type Config struct {
+	// Addresses to listen on for client connections. Listeners are
+	// only bound at startup and are not affected by reloads.
+	Listen []string `yaml:"listen"`
+	// Redis URL of the master, eg: redis://:password@127.0.0.1:6379
+	Backend string `yaml:"backend"`
+	// Redis URLs of known slaves of the master
+	Replicas []string       `yaml:"replicas,omitempty"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Log      LogConfig      `yaml:"log"`
+	Features FeaturesConfig `yaml:"features"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Slowlog  SlowlogConfig  `yaml:"slowlog"`
+	Tracing  TracingConfig  `yaml:"tracing"`
+	Retry    RetryConfig    `yaml:"retry"`
+	Breaker  BreakerConfig  `yaml:"breaker"`
+	// Applied in order. A command must pass every limit that applies to it.
+	RateLimits []RateLimitConfig `yaml:"rate_limits"`
+	Commands   CommandsConfig    `yaml:"commands"`
+	Namespaces NamespacesConfig  `yaml:"namespaces"`
+	Cache      CacheConfig       `yaml:"cache"`
+	Coalesce   CoalesceConfig    `yaml:"coalesce"`
+	Mirror     MirrorConfig      `yaml:"mirror"`
+	Migration  MigrationConfig   `yaml:"migration"`
+	Capture    CaptureConfig     `yaml:"capture"`
+	KeyStats   KeyStatsConfig    `yaml:"key_stats"`
+}
+
+type TimeoutsConfig struct {
+	// Time allowed to establish a backend connection. Zero means no timeout.
+	Connect Duration `yaml:"connect"`
+	// Time allowed for the backend to reply to AUTH. Zero means no timeout.
+	Auth Duration `yaml:"auth"`
+	// Time allowed for in-flight commands to finish on shutdown. Zero means
+	// no timeout.
+	Drain Duration `yaml:"drain"`
+	// Clients idle for longer are disconnected, unless they are subscribed.
+	// Zero means never.
+	Idle Duration `yaml:"idle"`
+	// Time allowed for the backend to reply to a command, blocking commands
+	// excepted. The client is disconnected if it doesn't. Zero means no
+	// timeout.
+	Command Duration `yaml:"command"`
+	// Period of TCP keepalive probes on client connections. Zero disables
+	// them.
+	KeepAlive Duration `yaml:"keepalive"`
+}
+
+// RetryConfig controls how failed backend connections are retried
+type RetryConfig struct {
+	// Attempts per client connection. 1 means no retries.
+	Attempts int `yaml:"attempts"`
+	// Retries wait a random delay of up to backoff, which doubles on every
+	// retry up to max_backoff
+	Backoff    Duration `yaml:"backoff"`
+	MaxBackoff Duration `yaml:"max_backoff"`
+}
+
+// BreakerConfig controls the circuit breaker on backend connections
+type BreakerConfig struct {
+	// Consecutive failures that open the breaker. Zero disables it.
+	Threshold int `yaml:"threshold"`
+	// How long the breaker stays open before probing the backend
+	Cooldown Duration `yaml:"cooldown"`
+}
+
+// CommandsConfig restricts and transforms the commands clients send
+type CommandsConfig struct {
+	Deny []DenyConfig `yaml:"deny"`
+	// Like Redis's rename-command, clients must use the new name and the old
+	// one becomes unknown. Renaming to "" disables a command.
+	Rename map[string]string `yaml:"rename"`
+	// Commands forwarded as another, eg: DEL as UNLINK. KEYS may only be
+	// rewritten into SCAN, which iterates the keyspace incrementally.
+	Rewrite map[string]string `yaml:"rewrite"`
+}
+
+// NamespacesConfig prefixes the keys of clients' commands, so that tenants
+// sharing a backend can't see each other's keys. A user's namespace takes
+// precedence over the listener's.
+type NamespacesConfig struct {
+	// Prefixes by listen address, eg: ":9737": "tenant-a:"
+	Listeners map[string]string `yaml:"listeners"`
+	// Prefixes by authenticated user
+	Users map[string]string `yaml:"users"`
+}
+
+// CacheConfig keeps replies to reads of some keys in the proxy, so that hot
+// keys are served without a round trip to the backend
+type CacheConfig struct {
+	// Glob-style patterns of the keys cached, including any namespace.
+	// Empty disables the cache.
+	Keys []string `yaml:"keys"`
+	// Memory held by cached replies, beyond which the least recently used
+	// are evicted
+	MaxBytes int `yaml:"max_bytes"`
+	// Cached replies expire after this. Zero means they only expire when
+	// invalidated.
+	TTL Duration `yaml:"ttl"`
+	// Whether the backend's invalidations are subscribed to with Redis 6's
+	// CLIENT TRACKING. Without it, only writes made through the proxy
+	// invalidate cached replies.
+	Tracking bool `yaml:"tracking"`
+}
+
+// CoalesceConfig merges identical reads in flight at the same time into a
+// single backend request, whose reply is sent to every client waiting on it
+type CoalesceConfig struct {
+	// Read-only commands coalesced. Empty disables coalescing.
+	Commands []string `yaml:"commands"`
+	// Glob-style patterns of the keys coalesced. Empty means all keys.
+	Keys []string `yaml:"keys"`
+}
+
+// MirrorConfig copies the commands clients send to a second backend, whose
+// replies are discarded. Clients are only ever answered by the primary.
+type MirrorConfig struct {
+	// Redis URL of the mirror. Empty disables mirroring.
+	Backend string `yaml:"backend"`
+	// Fraction of commands copied, between 0 and 1
+	SampleRate float64 `yaml:"sample_rate"`
+	// Only copy read-only commands
+	ReadOnly bool `yaml:"read_only"`
+	// Connections to the mirror. The commands of a client all go through
+	// the same one, in order.
+	Connections int `yaml:"connections"`
+	// Commands waiting to be sent to the mirror, beyond which they are
+	// dropped
+	QueueSize int `yaml:"queue_size"`
+	// Compare the mirror's replies to deterministic reads with the
+	// primary's, logging those that differ
+	Compare bool `yaml:"compare"`
+}
+
+// MigrationConfig moves the data to a new backend. Writes go to both
+// backends and reads to the old one until REDIX MIGRATE CUTOVER.
+type MigrationConfig struct {
+	// Redis URL of the backend migrated to. Empty means no migration.
+	Target string `yaml:"target"`
+	// Connections copying keys to the target. Each key is always copied
+	// by the same one.
+	Workers int `yaml:"workers"`
+	// Keys asked for by each SCAN of REDIX MIGRATE COPY
+	BatchSize int `yaml:"batch_size"`
+	// Keys waiting to be copied, beyond which writes wait for them
+	QueueSize int `yaml:"queue_size"`
+}
+
+// CaptureConfig records the commands clients send between REDIX CAPTURE
+// START and STOP, to be replayed by redix-replay
+type CaptureConfig struct {
+	// File the capture is written to, replacing any previous one
+	File string `yaml:"file"`
+	// Record the replies to commands as well
+	Replies bool `yaml:"replies"`
+	// The capture stops once the file reaches this size. Zero means no limit.
+	MaxBytes int64 `yaml:"max_bytes"`
+}
+
+// KeyStatsConfig finds the hot keys and big keys reported by REDIX HOTKEYS
+// and REDIX BIGKEYS
+type KeyStatsConfig struct {
+	// Fraction of commands whose keys are counted towards hot keys. Zero
+	// disables hot keys.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Number of hot keys and of big keys kept. Zero disables both.
+	TopK int `yaml:"top_k"`
+	// Access counts are halved this often, so that keys that cool down make
+	// way for others. Zero means never.
+	DecayInterval Duration `yaml:"decay_interval"`
+}
+
+// DenyConfig rejects commands with a NOPERM error
+type DenyConfig struct {
+	// Command names, optionally followed by a subcommand, eg: "config set"
+	Commands []string `yaml:"commands"`
+	// The users denied. Empty means all users.
+	Users []string `yaml:"users,omitempty"`
+}
+
+// RateLimitConfig is a token bucket limiting the rate of some commands
+type RateLimitConfig struct {
+	// Named in rejections
+	Name string `yaml:"name"`
+	// The commands limited, by name or category (eg: @write). Empty means
+	// all.
+	Commands []string `yaml:"commands"`
+	// Whether each client ip, each user or the whole proxy has its own
+	// bucket: ip, user or global
+	Per string `yaml:"per"`
+	// Commands allowed per interval
+	Rate     float64  `yaml:"rate"`
+	Interval Duration `yaml:"interval"`
+	// Commands allowed at once. Defaults to rate.
+	Burst int `yaml:"burst,omitempty"`
+	// Whether commands over the limit are rejected or delayed: reject or
+	// delay. Delayed commands are rejected if they would wait longer than
+	// max_delay, so a delay with no max_delay is the same as reject.
+	Action   string   `yaml:"action"`
+	MaxDelay Duration `yaml:"max_delay,omitempty"`
+}
+
+type LimitsConfig struct {
+	// Maximum number of simultaneous clients. Zero means unlimited.
+	MaxClients   int                `yaml:"max_clients"`
+	OutputBuffer OutputBufferConfig `yaml:"output_buffer"`
+}
+
+// OutputBufferConfig limits the replies buffered for a subscribed or
+// monitoring client that reads them slower than the backend sends them.
+// Like Redis's client-output-buffer-limit, the client is disconnected once
+// the buffer exceeds the hard limit, or exceeds the soft limit for longer
+// than the soft duration. Zero disables a limit.
+type OutputBufferConfig struct {
+	HardBytes    int      `yaml:"hard_bytes"`
+	SoftBytes    int      `yaml:"soft_bytes"`
+	SoftDuration Duration `yaml:"soft_duration"`
+}
+
+type AuthConfig struct {
+	// If set, clients must AUTH with this password before
+	// any command is forwarded to the backend.
+	Password string `yaml:"password,omitempty"`
+	// Passwords of named users, who AUTH with their username. Clients
+	// authenticating with the password alone are the default user.
+	Users map[string]string `yaml:"users,omitempty"`
+	// Users allowed PROMOTE and the REDIX subcommands that change the
+	// proxy, eg: CONFIG SET, KILL and UPGRADE. If empty, no user may once
+	// auth is required, and any client may otherwise.
+	Admins []string `yaml:"admins,omitempty"`
+}
+
+func (limit RateLimitConfig) validate() error {
+	if limit.Name == "" {
+		return errors.New("config: rate_limits need a name")
+	}
+	prefix := "config: rate limit " + limit.Name
+	switch limit.Per {
+	case "ip", "user", "global":
+	default:
+		return errors.New(prefix + ": per must be ip, user or global")
+	}
+	switch limit.Action {
+	case "reject", "delay":
+	default:
+		return errors.New(prefix + ": action must be reject or delay")
+	}
+	if limit.Rate <= 0 || limit.Interval <= 0 {
+		return errors.New(prefix + ": rate and interval must be positive")
+	}
+	if limit.Burst < 0 || limit.MaxDelay < 0 {
+		return errors.New(prefix + ": burst and max_delay must not be negative")
+	}
+	return nil
+}
+
+// DefaultUser is the user of clients that don't AUTH with a username
+const DefaultUser = "default"
+
+// Admin reports whether the user may run PROMOTE, MONITOR and the REDIX
+// subcommands that change the proxy or expose other clients' keys. Without
+// admins, only clients of a proxy without auth may.
+func (auth AuthConfig) Admin(user string) bool {
+	if len(auth.Admins) == 0 {
+		return !auth.Required()
+	}
+	for _, admin := range auth.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Required reports whether clients must AUTH
+func (auth AuthConfig) Required() bool {
+	return auth.Password != "" || len(auth.Users) > 0
+}
+
+// Check returns the user authenticated by the arguments of AUTH
+func (auth AuthConfig) Check(args Array) (string, bool) {
+	switch len(args) {
+	case 1:
+		return DefaultUser, auth.Password != "" && args[0].String() == auth.Password
+	case 2:
+		user := args[0].String()
+		if user == DefaultUser {
+			return user, auth.Password != "" && args[1].String() == auth.Password
+		}
+		password, ok := auth.Users[user]
+		return user, ok && args[1].String() == password
+	default:
+		return "", false
+	}
+}
+
+type LogConfig struct {
+	// One of debug, info, warn or error. Commands are logged at debug.
+	Level string `yaml:"level"`
+	// Either text or json. Only read at startup.
+	Format string `yaml:"format"`
+	// Fraction of commands logged at debug level, between 0 and 1
+	SampleRate float64 `yaml:"sample_rate"`
+}
+
+type FeaturesConfig struct {
+	Promote bool `yaml:"promote"`
+	// Replace the built-in command table with the backend's COMMAND reply
+	// when clients first connect to it
+	RefreshCommands bool `yaml:"refresh_commands"`
+}
+
+type MetricsConfig struct {
+	// Address to serve Prometheus metrics on at /metrics. Empty disables it.
+	Listen string `yaml:"listen,omitempty"`
+}
+
+type SlowlogConfig struct {
+	// Commands taking longer than this, from being read off the client
+	// connection to their reply being written, are logged. Zero logs every
+	// command and a negative threshold disables the slowlog.
+	Threshold Duration `yaml:"threshold"`
+	// Number of entries kept
+	MaxLen int `yaml:"max_len"`
+}
+
+// TracingConfig is only read at startup
+type TracingConfig struct {
+	// Either otlp, file or empty to disable tracing
+	Exporter string `yaml:"exporter,omitempty"`
+	// host:port of an OTLP/HTTP collector
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Send to the collector over plain HTTP
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Path of the file that spans are appended to as JSON
+	File string `yaml:"file,omitempty"`
+	// Fraction of traces started by the proxy that are sampled
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+// DefaultConfig returns the configuration used when no file is given.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:  []string{":9736"},
+		Backend: "redis://127.0.0.1:6379",
+		Timeouts: TimeoutsConfig{
+			Connect:   Duration(5 * time.Second),
+			Auth:      Duration(5 * time.Second),
+			Drain:     Duration(10 * time.Second),
+			KeepAlive: Duration(300 * time.Second),
+		},
+		Limits: LimitsConfig{
+			OutputBuffer: OutputBufferConfig{HardBytes: 32 << 20, SoftBytes: 8 << 20, SoftDuration: Duration(60 * time.Second)},
+		},
+		Log:       LogConfig{Level: "info", Format: "text", SampleRate: 1},
+		Features:  FeaturesConfig{Promote: true},
+		Slowlog:   SlowlogConfig{Threshold: Duration(10 * time.Millisecond), MaxLen: 128},
+		Tracing:   TracingConfig{SampleRatio: 1, ServiceName: "redix"},
+		Retry:     RetryConfig{Attempts: 3, Backoff: Duration(50 * time.Millisecond), MaxBackoff: Duration(time.Second)},
+		Breaker:   BreakerConfig{Threshold: 5, Cooldown: Duration(5 * time.Second)},
+		Cache:     CacheConfig{MaxBytes: 64 << 20, TTL: Duration(60 * time.Second), Tracking: true},
+		Mirror:    MirrorConfig{SampleRate: 1, Connections: 4, QueueSize: 10000},
+		Migration: MigrationConfig{Workers: 4, BatchSize: 100, QueueSize: 10000},
+		Capture:   CaptureConfig{File: "redix.capture", MaxBytes: 1 << 30},
+		KeyStats:  KeyStatsConfig{SampleRate: 0.1, TopK: 20, DecayInterval: Duration(time.Minute)},
+	}
+}
+
+// ParseConfig reads a YAML config on top of DefaultConfig and validates it
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+func (cfg *Config) Validate() error {
+	if len(cfg.Listen) == 0 {
+		return errors.New("config: at least one listen address is required")
+	}
+	for _, addr := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("config: invalid listen address %q: %v", addr, err)
+		}
+	}
+	if _, _, _, err := ParseRedisURL(cfg.Backend); err != nil {
+		return fmt.Errorf("config: invalid backend: %v", err)
+	}
+	for _, replica := range cfg.Replicas {
+		if _, _, _, err := ParseRedisURL(replica); err != nil {
+			return fmt.Errorf("config: invalid replica: %v", err)
+		}
+	}
+	if cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			return fmt.Errorf("config: invalid metrics.listen address %q: %v", cfg.Metrics.Listen, err)
+		}
+	}
+	if _, err := parseLevel(cfg.Log.Level); err != nil {
+		return fmt.Errorf("config: invalid log.level %q", cfg.Log.Level)
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		return fmt.Errorf("config: log.format must be text or json")
+	}
+	if cfg.Log.SampleRate < 0 || cfg.Log.SampleRate > 1 {
+		return errors.New("config: log.sample_rate must be between 0 and 1")
+	}
+	if cfg.Slowlog.MaxLen < 0 {
+		return errors.New("config: slowlog.max_len must not be negative")
+	}
+	switch cfg.Tracing.Exporter {
+	case "":
+	case "otlp":
+		if cfg.Tracing.Endpoint == "" {
+			return errors.New("config: tracing.endpoint is required by the otlp exporter")
+		}
+	case "file":
+		if cfg.Tracing.File == "" {
+			return errors.New("config: tracing.file is required by the file exporter")
+		}
+	default:
+		return fmt.Errorf("config: tracing.exporter must be otlp or file")
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		return errors.New("config: tracing.sample_ratio must be between 0 and 1")
+	}
+	if cfg.Timeouts.Connect < 0 {
+		return errors.New("config: timeouts.connect must not be negative")
+	}
+	if cfg.Timeouts.Auth < 0 {
+		return errors.New("config: timeouts.auth must not be negative")
+	}
+	if cfg.Timeouts.Drain < 0 {
+		return errors.New("config: timeouts.drain must not be negative")
+	}
+	if cfg.Timeouts.Idle < 0 {
+		return errors.New("config: timeouts.idle must not be negative")
+	}
+	if cfg.Timeouts.Command < 0 {
+		return errors.New("config: timeouts.command must not be negative")
+	}
+	if cfg.Timeouts.KeepAlive < 0 {
+		return errors.New("config: timeouts.keepalive must not be negative")
+	}
+	if cfg.Retry.Attempts < 1 {
+		return errors.New("config: retry.attempts must be at least 1")
+	}
+	if cfg.Retry.Backoff < 0 || cfg.Retry.MaxBackoff < 0 {
+		return errors.New("config: retry backoffs must not be negative")
+	}
+	if cfg.Breaker.Threshold < 0 || cfg.Breaker.Cooldown < 0 {
+		return errors.New("config: breaker.threshold and breaker.cooldown must not be negative")
+	}
+	renamed := map[string]bool{}
+	for name, to := range cfg.Commands.Rename {
+		if to == "" {
+			continue
+		}
+		if renamed[strings.ToLower(to)] {
+			return fmt.Errorf("config: commands.rename renames two commands to '%s'", to)
+		}
+		renamed[strings.ToLower(to)] = true
+		if _, ok := cfg.Commands.Rename[strings.ToLower(to)]; ok && !strings.EqualFold(name, to) {
+			return fmt.Errorf("config: commands.rename renames '%s' to a renamed command", name)
+		}
+	}
+	for name, to := range cfg.Commands.Rewrite {
+		if strings.EqualFold(name, "keys") && !strings.EqualFold(to, "scan") {
+			return errors.New("config: commands.rewrite can only rewrite keys into scan")
+		}
+	}
+	for _, limit := range cfg.RateLimits {
+		if err := limit.validate(); err != nil {
+			return err
+		}
+	}
+	for addr, prefix := range cfg.Namespaces.Listeners {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("config: invalid namespaces.listeners address %q: %v", addr, err)
+		}
+		if prefix == "" {
+			return fmt.Errorf("config: namespaces.listeners prefix of %q is empty", addr)
+		}
+	}
+	for user, prefix := range cfg.Namespaces.Users {
+		if prefix == "" {
+			return fmt.Errorf("config: namespaces.users prefix of %q is empty", user)
+		}
+	}
+	if cfg.Cache.MaxBytes < 0 || cfg.Cache.TTL < 0 {
+		return errors.New("config: cache.max_bytes and cache.ttl must not be negative")
+	}
+	for _, name := range cfg.Coalesce.Commands {
+		if info, ok := LookupCommand(name); !ok || !info.ReadOnly() || info.Blocking() {
+			return fmt.Errorf("config: coalesce.commands: '%s' is not a non-blocking read-only command", name)
+		}
+	}
+	if cfg.Mirror.Backend != "" {
+		if _, _, _, err := ParseRedisURL(cfg.Mirror.Backend); err != nil {
+			return fmt.Errorf("config: invalid mirror.backend: %v", err)
+		}
+	}
+	if cfg.Mirror.SampleRate < 0 || cfg.Mirror.SampleRate > 1 {
+		return errors.New("config: mirror.sample_rate must be between 0 and 1")
+	}
+	if cfg.Mirror.Connections < 1 || cfg.Mirror.QueueSize < 0 {
+		return errors.New("config: mirror.connections must be positive and mirror.queue_size not negative")
+	}
+	if cfg.Migration.Target != "" {
+		if _, _, _, err := ParseRedisURL(cfg.Migration.Target); err != nil {
+			return fmt.Errorf("config: invalid migration.target: %v", err)
+		}
+	}
+	if cfg.Migration.Workers < 1 || cfg.Migration.BatchSize < 1 || cfg.Migration.QueueSize < 0 {
+		return errors.New("config: migration.workers and migration.batch_size must be positive and migration.queue_size not negative")
+	}
+	if cfg.Capture.MaxBytes < 0 {
+		return errors.New("config: capture.max_bytes must not be negative")
+	}
+	if cfg.KeyStats.SampleRate < 0 || cfg.KeyStats.SampleRate > 1 {
+		return errors.New("config: key_stats.sample_rate must be between 0 and 1")
+	}
+	if cfg.KeyStats.TopK < 0 || cfg.KeyStats.DecayInterval < 0 {
+		return errors.New("config: key_stats.top_k and key_stats.decay_interval must not be negative")
+	}
+	if cfg.Limits.MaxClients < 0 {
+		return errors.New("config: limits.max_clients must not be negative")
+	}
+	if ob := cfg.Limits.OutputBuffer; ob.HardBytes < 0 || ob.SoftBytes < 0 || ob.SoftDuration < 0 {
+		return errors.New("config: limits.output_buffer limits must not be negative")
+	}
+	return nil
+}
+
+func (cfg *Config) Clone() *Config {
+	clone := *cfg
+	clone.Listen = append([]string(nil), cfg.Listen...)
+	clone.Replicas = append([]string(nil), cfg.Replicas...)
+	return &clone
+}
+
+// WriteFile atomically replaces the file at path with the YAML encoded
+// config. The file keeps its mode and, where allowed, its owner, as it holds
+// credentials.
+func (cfg *Config) WriteFile(path string) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	mode, uid, gid := os.FileMode(0600), -1, -1
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Not umasked, unlike the mode given to OpenFile
+		err = os.Chmod(tmp, mode)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if uid >= 0 {
+		// Only permitted to root, otherwise the file is owned by the proxy
+		os.Chown(tmp, uid, gid)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Params flattens the config into dotted parameter names (eg: "timeouts.connect")
+// and their values, in the style of CONFIG GET. Lists are space separated.
+// Passwords are left out, including those of URLs.
+func (cfg *Config) Params() map[string]string {
+	params := map[string]string{}
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			name := prefix + yamlName(v.Type().Field(i))
+			field := v.Field(i)
+			if secretParams[name] {
+				continue
+			}
+			switch value := field.Interface().(type) {
+			case Duration:
+				params[name] = time.Duration(value).String()
+			case string:
+				params[name] = stripUserinfo(value)
+			case []string:
+				values := make([]string, len(value))
+				for i, value := range value {
+					values[i] = stripUserinfo(value)
+				}
+				params[name] = strings.Join(values, " ")
+			default:
+				if field.Kind() == reflect.Struct {
+					walk(name+".", field)
+					continue
+				}
+				// Users and rules are only set in the file
+				if field.Kind() == reflect.Map || field.Kind() == reflect.Slice {
+					continue
+				}
+				params[name] = fmt.Sprint(value)
+			}
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return params
+}
+
+// Parameters left out of Params. They, and the rest of auth, are only set
+// in the file.
+var secretParams = map[string]bool{"auth.password": true}
+
+// Removes the username and password of URLs
+func stripUserinfo(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	u.User = nil
+	return u.String()
+}
+
+// Get returns the parameters matching a glob pattern, sorted by name
+func (cfg *Config) Get(pattern string) [][2]string {
+	var matches [][2]string
+	for name, value := range cfg.Params() {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			matches = append(matches, [2]string{name, value})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
+	return matches
+}
+
+// Set changes a single parameter as named by Params. The config is not
+// validated.
+func (cfg *Config) Set(param, value string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	parts := strings.Split(strings.ToLower(param), ".")
+	if parts[0] == "auth" {
+		return fmt.Errorf("config parameter '%s' can't be set at runtime", param)
+	}
+	for i, part := range parts {
+		field, ok := fieldByYAMLName(v, part)
+		if !ok || (i < len(parts)-1) != (field.Kind() == reflect.Struct) {
+			return fmt.Errorf("unknown config parameter '%s'", param)
+		}
+		v = field
+	}
+
+	switch v.Interface().(type) {
+	case Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for '%s'", param)
+		}
+		v.Set(reflect.ValueOf(Duration(d)))
+	case []string:
+		v.Set(reflect.ValueOf(strings.Fields(value)))
+	default:
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean for '%s'", param)
+			}
+			v.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid integer for '%s'", param)
+			}
+			v.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number for '%s'", param)
+			}
+			v.SetFloat(f)
+		default:
+			return fmt.Errorf("config parameter '%s' can't be set at runtime", param)
+		}
+	}
+	return nil
+}
+
+func yamlName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func fieldByYAMLName(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if yamlName(v.Type().Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// ConfigWatcher holds the current config and reloads it from disk when the
+// file changes. Readers should call Config for every new connection so that
+// reloads take effect without disturbing connections that are already open.
+type ConfigWatcher struct {
+	mu      sync.RWMutex
+	path    string
+	cfg     *Config
+	modTime time.Time
+	// Runtime changes not yet rewritten to the file, applied again on top
+	// of it when it is reloaded
+	changes []func(cfg *Config)
+
+	// OnReload, if set, is called with the previous and new configs
+	// after every successful reload.
+	OnReload func(old, cfg *Config)
+}
+
+func NewConfigWatcher(path string) (*ConfigWatcher, error) {
+	watcher := &ConfigWatcher{path: path}
+	if err := watcher.Reload(); err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// StaticConfig returns a watcher for a config that isn't backed by a
+// file. Runtime changes are allowed, but can't be reloaded or rewritten.
+func StaticConfig(cfg *Config) *ConfigWatcher {
+	return &ConfigWatcher{cfg: cfg}
+}
+
+var ErrNoConfigFile = errors.New("the proxy is running without a config file")
+
+// Config returns the current config, which must not be modified
+func (watcher *ConfigWatcher) Config() *Config {
+	watcher.mu.RLock()
+	defer watcher.mu.RUnlock()
+	return watcher.cfg
+}
+
+// Reload reads and validates the config file, and applies the runtime
+// changes not yet rewritten to it, so that eg: a promoted backend isn't
+// reverted. An invalid file leaves the current config in place.
+func (watcher *ConfigWatcher) Reload() error {
+	if watcher.path == "" {
+		return ErrNoConfigFile
+	}
+	info, err := os.Stat(watcher.path)
+	if err != nil {
+		return err
+	}
+	cfg, err := LoadConfig(watcher.path)
+	if err != nil {
+		return err
+	}
+
+	watcher.mu.Lock()
+	for _, change := range watcher.changes {
+		change(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		watcher.mu.Unlock()
+		return err
+	}
+	old := watcher.cfg
+	watcher.cfg = cfg
+	watcher.modTime = info.ModTime()
+	watcher.mu.Unlock()
+
+	if old != nil && watcher.OnReload != nil {
+		watcher.OnReload(old, cfg)
+	}
+	return nil
+}
+
+// Update applies a runtime change to a copy of the current config. The
+// change lives in memory until Rewrite is called, and is applied again on
+// top of the file when it is reloaded. OnReload is called as for a reload.
+func (watcher *ConfigWatcher) Update(change func(cfg *Config)) error {
+	watcher.mu.Lock()
+
+	old := watcher.cfg
+	cfg := old.Clone()
+	change(cfg)
+	if err := cfg.Validate(); err != nil {
+		watcher.mu.Unlock()
+		return err
+	}
+	watcher.cfg = cfg
+	watcher.changes = append(watcher.changes, change)
+	watcher.mu.Unlock()
+
+	if watcher.OnReload != nil {
+		watcher.OnReload(old, cfg)
+	}
+	return nil
+}
+
+// Unpersisted reports whether there are runtime changes that Rewrite hasn't
+// written to the file
+func (watcher *ConfigWatcher) Unpersisted() bool {
+	watcher.mu.RLock()
+	defer watcher.mu.RUnlock()
+	return watcher.path != "" && len(watcher.changes) > 0
+}
+
+// Rewrite persists the current config, including runtime changes, to the file
+func (watcher *ConfigWatcher) Rewrite() error {
+	if watcher.path == "" {
+		return ErrNoConfigFile
+	}
+
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if err := watcher.cfg.WriteFile(watcher.path); err != nil {
+		return err
+	}
+	watcher.changes = nil
+	if info, err := os.Stat(watcher.path); err == nil {
+		watcher.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Watch polls the config file every interval and reloads it when its
+// modification time changes. Reload errors are sent to errs if it is
+// not nil. Watch returns when done is closed.
+func (watcher *ConfigWatcher) Watch(interval time.Duration, done <-chan struct{}, errs chan<- error) {
+	if watcher.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(watcher.path)
+		if err != nil {
+			continue
+		}
+		watcher.mu.RLock()
+		changed := !info.ModTime().Equal(watcher.modTime)
+		watcher.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := watcher.Reload(); err != nil {
+			// Don't retry the same broken file on every tick
+			watcher.mu.Lock()
+			watcher.modTime = info.ModTime()
+			watcher.mu.Unlock()
+			if errs != nil {
+				errs <- err
+			}
+		}
+	}
+}
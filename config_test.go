@@ -0,0 +1,127 @@
+package redix_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Config", func() {
+	Context("ParseConfig", func() {
+		It("Should apply defaults.", func() {
+			cfg, err := redix.ParseConfig([]byte("backend: redis://:secret@10.0.0.1:6380\n"))
+			Expect(err).To(BeNil())
+			Expect(cfg.Listen).To(Equal([]string{":9736"}))
+			Expect(cfg.Backend).To(Equal("redis://:secret@10.0.0.1:6380"))
+			Expect(time.Duration(cfg.Timeouts.Connect)).To(Equal(5 * time.Second))
+		})
+		It("Should parse durations.", func() {
+			cfg, err := redix.ParseConfig([]byte("timeouts:\n  connect: 250ms\n"))
+			Expect(err).To(BeNil())
+			Expect(time.Duration(cfg.Timeouts.Connect)).To(Equal(250 * time.Millisecond))
+		})
+		It("Should reject invalid configs.", func() {
+			_, err := redix.ParseConfig([]byte("listen: []\n"))
+			Expect(err).NotTo(BeNil())
+
+			_, err = redix.ParseConfig([]byte("backend: redis://nope\n"))
+			Expect(err).NotTo(BeNil())
+
+			_, err = redix.ParseConfig([]byte("limits:\n  max_clients: -1\n"))
+			Expect(err).NotTo(BeNil())
+
+			_, err = redix.ParseConfig([]byte("timeouts:\n  connect: soon\n"))
+			Expect(err).NotTo(BeNil())
+
+			_, err = redix.ParseConfig([]byte("coalesce:\n  commands: [incr]\n"))
+			Expect(err).NotTo(BeNil())
+		})
+	})
+
+	Context("Params", func() {
+		It("Should leave out passwords.", func() {
+			cfg, err := redix.ParseConfig([]byte("backend: redis://:secret@10.0.0.1:6380\nreplicas: [redis://:secret@10.0.0.2:6380]\nauth:\n  password: secret\n"))
+			Expect(err).To(BeNil())
+			params := cfg.Params()
+			Expect(params).NotTo(HaveKey("auth.password"))
+			Expect(params).To(HaveKeyWithValue("backend", "redis://10.0.0.1:6380"))
+			Expect(params).To(HaveKeyWithValue("replicas", "redis://10.0.0.2:6380"))
+		})
+	})
+
+	Context("ConfigWatcher", func() {
+		var dir, path string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "redix")
+			Expect(err).To(BeNil())
+			path = filepath.Join(dir, "redix.yml")
+			Expect(ioutil.WriteFile(path, []byte("backend: redis://127.0.0.1:6379\n"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Should keep the old config when a reload is invalid.", func() {
+			watcher, err := redix.NewConfigWatcher(path)
+			Expect(err).To(BeNil())
+
+			Expect(ioutil.WriteFile(path, []byte("backend: nope\n"), 0644)).To(Succeed())
+			Expect(watcher.Reload()).NotTo(Succeed())
+			Expect(watcher.Config().Backend).To(Equal("redis://127.0.0.1:6379"))
+		})
+		It("Should notify on reload.", func() {
+			watcher, err := redix.NewConfigWatcher(path)
+			Expect(err).To(BeNil())
+
+			var reloaded *redix.Config
+			watcher.OnReload = func(old, cfg *redix.Config) { reloaded = cfg }
+			Expect(ioutil.WriteFile(path, []byte("backend: redis://127.0.0.1:6380\n"), 0644)).To(Succeed())
+			Expect(watcher.Reload()).To(Succeed())
+			Expect(reloaded).NotTo(BeNil())
+			Expect(reloaded.Backend).To(Equal("redis://127.0.0.1:6380"))
+		})
+		It("Should rewrite runtime changes to the file.", func() {
+			watcher, err := redix.NewConfigWatcher(path)
+			Expect(err).To(BeNil())
+
+			Expect(watcher.Update(func(cfg *redix.Config) { cfg.Backend = "redis://127.0.0.1:7000" })).To(Succeed())
+			Expect(watcher.Rewrite()).To(Succeed())
+
+			cfg, err := redix.LoadConfig(path)
+			Expect(err).To(BeNil())
+			Expect(cfg.Backend).To(Equal("redis://127.0.0.1:7000"))
+		})
+		It("Should keep runtime changes across reloads until rewritten.", func() {
+			watcher, err := redix.NewConfigWatcher(path)
+			Expect(err).To(BeNil())
+			Expect(watcher.Update(func(cfg *redix.Config) { cfg.Backend = "redis://127.0.0.1:7000" })).To(Succeed())
+			Expect(watcher.Unpersisted()).To(BeTrue())
+
+			Expect(ioutil.WriteFile(path, []byte("backend: redis://127.0.0.1:6379\nlimits:\n  max_clients: 10\n"), 0644)).To(Succeed())
+			Expect(watcher.Reload()).To(Succeed())
+			Expect(watcher.Config().Backend).To(Equal("redis://127.0.0.1:7000"))
+			Expect(watcher.Config().Limits.MaxClients).To(Equal(10))
+
+			Expect(watcher.Rewrite()).To(Succeed())
+			Expect(watcher.Unpersisted()).To(BeFalse())
+		})
+		It("Should keep the mode of the file when rewriting it.", func() {
+			Expect(os.Chmod(path, 0600)).To(Succeed())
+			watcher, err := redix.NewConfigWatcher(path)
+			Expect(err).To(BeNil())
+			Expect(watcher.Rewrite()).To(Succeed())
+
+			info, err := os.Stat(path)
+			Expect(err).To(BeNil())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+	})
+})
@@ -4,15 +4,72 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
+// ParseRedisURL splits a URL of the form redis://:password@host:port
+// into its dialable parts.
+func ParseRedisURL(rawurl string) (ip, port, auth string, err error) {
+	redisURL, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", "", err
+	}
+	ip, port, err = net.SplitHostPort(redisURL.Host)
+	if err != nil {
+		return "", "", "", err
+	}
+	if redisURL.User != nil {
+		if password, ok := redisURL.User.Password(); ok {
+			auth = password
+		}
+	}
+	return ip, port, auth, nil
+}
+
+// ErrBackendUnavailable is returned by Dial while its circuit breaker is open
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+// ErrInvalidPassword is returned by Dial when the backend rejects its AUTH.
+// Such dials aren't retried, nor counted by the circuit breaker.
+var ErrInvalidPassword = errors.New("invalid password")
+
 type Dialer struct {
 	mu   sync.RWMutex
 	IP   string
 	Port string
 	Auth string
+	// Time allowed to connect. Zero means no timeout.
+	Timeout time.Duration
+	// Time allowed for the backend to reply to AUTH. Zero means no timeout.
+	AuthTimeout time.Duration
+	// Number of attempts per dial. Less than 2 means no retries.
+	Attempts int
+	// Attempts are spaced by a random delay of up to Backoff, doubling on
+	// every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Optional. Fails dials fast while the backend is down.
+	Breaker *Breaker
+
+	// See DialStats
+	successes, failures, rejected, retries int64
+}
+
+// DialStats counts a Dialer's attempts to connect since it was created
+type DialStats struct {
+	Successes int64
+	Failures  int64
+	// Attempts rejected by an open circuit breaker
+	Rejected int64
+	Retries  int64
 }
 
 // Call Lock before executing this method
@@ -20,15 +77,103 @@ func (dialer *Dialer) Reset(ip, port, auth string) {
 	dialer.IP, dialer.Port, dialer.Auth = ip, port, auth
 }
 
+// Update is like Reset, but acquires the lock itself
+func (dialer *Dialer) Update(ip, port, auth string) {
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	dialer.Reset(ip, port, auth)
+}
+
+// Addr returns the host:port of the current backend
+func (dialer *Dialer) Addr() string {
+	dialer.mu.RLock()
+	defer dialer.mu.RUnlock()
+	return net.JoinHostPort(dialer.IP, dialer.Port)
+}
+
+func (dialer *Dialer) Stats() DialStats {
+	return DialStats{
+		Successes: atomic.LoadInt64(&dialer.successes),
+		Failures:  atomic.LoadInt64(&dialer.failures),
+		Rejected:  atomic.LoadInt64(&dialer.rejected),
+		Retries:   atomic.LoadInt64(&dialer.retries),
+	}
+}
+
 func (dialer *Dialer) Dial() (net.Conn, error) {
+	return dialer.DialContext(context.Background())
+}
+
+// DialContext connects and authenticates to the backend, retrying failed
+// attempts with jittered exponential backoff until ctx is done
+func (dialer *Dialer) DialContext(ctx context.Context) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		if dialer.Breaker != nil && !dialer.Breaker.allow() {
+			atomic.AddInt64(&dialer.rejected, 1)
+			return nil, ErrBackendUnavailable
+		}
+		conn, err := dialer.dial(ctx)
+		if dialer.Breaker != nil {
+			// The backend isn't to blame if the caller gave up, nor down if
+			// it rejected the password
+			if err != nil && (ctx.Err() != nil || err == ErrInvalidPassword) {
+				dialer.Breaker.abort()
+			} else {
+				dialer.Breaker.record(err == nil)
+			}
+		}
+		if err == nil {
+			atomic.AddInt64(&dialer.successes, 1)
+			return conn, nil
+		}
+		atomic.AddInt64(&dialer.failures, 1)
+
+		dialer.mu.RLock()
+		attempts, backoff, maxBackoff := dialer.Attempts, dialer.Backoff, dialer.MaxBackoff
+		dialer.mu.RUnlock()
+		if attempt >= attempts || ctx.Err() != nil || err == ErrInvalidPassword {
+			return nil, err
+		}
+		for i := 1; i < attempt && (maxBackoff <= 0 || backoff < maxBackoff); i++ {
+			backoff *= 2
+		}
+		if maxBackoff > 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		var delay time.Duration
+		if backoff > 0 {
+			delay = time.Duration(rand.Int63n(int64(backoff)))
+		}
+		atomic.AddInt64(&dialer.retries, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// A single attempt. The lock is held so that promotions wait for it.
+func (dialer *Dialer) dial(ctx context.Context) (net.Conn, error) {
 	dialer.mu.RLock()
 	defer dialer.mu.RUnlock()
 
-	conn, err := net.Dial("tcp", dialer.IP+":"+dialer.Port)
+	netDialer := net.Dialer{Timeout: dialer.Timeout}
+	conn, err := netDialer.DialContext(ctx, "tcp", net.JoinHostPort(dialer.IP, dialer.Port))
 	if err != nil {
 		return nil, err
 	}
 	if len(dialer.Auth) > 0 {
+		deadline := time.Time{}
+		if dialer.AuthTimeout > 0 {
+			deadline = time.Now().Add(dialer.AuthTimeout)
+		}
+		if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+
 		if _, err := conn.Write([]byte(fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(dialer.Auth), dialer.Auth))); err != nil {
 			conn.Close()
 			return nil, err
@@ -40,9 +185,136 @@ func (dialer *Dialer) Dial() (net.Conn, error) {
 			// Two valid states: Auth set successfully, or no auth required.
 			if result != "+OK\r\n" && result != "-ERR Client sent AUTH, but no password is set\r\n" {
 				conn.Close()
-				return nil, errors.New("invalid password")
+				if authRejected(result) {
+					return nil, ErrInvalidPassword
+				}
+				// eg: -ERR max number of clients reached, -LOADING
+				return nil, errors.New(strings.TrimSpace(strings.TrimPrefix(result, "-")))
 			}
 		}
 	}
 	return conn, nil
 }
+
+// Whether the backend replied to AUTH that the credentials are wrong, as
+// opposed to being unable to serve the client for now
+func authRejected(reply string) bool {
+	return strings.HasPrefix(reply, "-WRONGPASS") || strings.HasPrefix(reply, "-ERR invalid password") ||
+		strings.HasPrefix(reply, "-ERR invalid username-password pair")
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	// Letting a single probe through
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker is a circuit breaker for dials. It opens after threshold
+// consecutive failures, rejecting dials for cooldown. It then lets a single
+// probe through, closing again if it succeeds and reopening if it fails.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trips     int64
+}
+
+// NewBreaker returns a closed Breaker. A threshold of zero disables it.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Configure changes the breaker's threshold and cooldown
+func (breaker *Breaker) Configure(threshold int, cooldown time.Duration) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.threshold, breaker.cooldown = threshold, cooldown
+	if threshold <= 0 {
+		breaker.state, breaker.failures = BreakerClosed, 0
+	}
+}
+
+func (breaker *Breaker) State() BreakerState {
+	if breaker == nil {
+		return BreakerClosed
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+// Trips returns how many times the breaker opened
+func (breaker *Breaker) Trips() int64 {
+	if breaker == nil {
+		return 0
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.trips
+}
+
+func (breaker *Breaker) allow() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.state {
+	case BreakerOpen:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			return false
+		}
+		breaker.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// The probe is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// Lets another dial probe if this one was abandoned
+func (breaker *Breaker) abort() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.state == BreakerHalfOpen {
+		breaker.state = BreakerOpen
+	}
+}
+
+func (breaker *Breaker) record(ok bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if ok {
+		breaker.state, breaker.failures = BreakerClosed, 0
+		return
+	}
+	breaker.failures++
+	if breaker.threshold <= 0 {
+		return
+	}
+	if breaker.state == BreakerHalfOpen || breaker.failures >= breaker.threshold {
+		if breaker.state == BreakerClosed {
+			breaker.trips++
+		}
+		breaker.state, breaker.openedAt = BreakerOpen, time.Now()
+	}
+}
@@ -0,0 +1,153 @@
+package redix_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Dialer", func() {
+	var (
+		addr   string
+		dialer *redix.Dialer
+	)
+
+	BeforeEach(func() {
+		// Nothing listens on addr once l is closed
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		addr = l.Addr().String()
+		l.Close()
+
+		ip, port, _ := net.SplitHostPort(addr)
+		dialer = &redix.Dialer{IP: ip, Port: port, Attempts: 1}
+	})
+
+	It("Should retry failed attempts.", func() {
+		dialer.Attempts = 3
+		dialer.Backoff = time.Millisecond
+		_, err := dialer.Dial()
+		Expect(err).NotTo(BeNil())
+		Expect(dialer.Stats()).To(Equal(redix.DialStats{Failures: 3, Retries: 2}))
+	})
+	It("Should give up when the context is done.", func() {
+		dialer.Attempts = 100
+		dialer.Backoff = time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := dialer.DialContext(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+	It("Should time out waiting for AUTH.", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer l.Close()
+		// Accepts but never replies
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		ip, port, _ := net.SplitHostPort(l.Addr().String())
+		dialer.Reset(ip, port, "secret")
+		dialer.AuthTimeout = 50 * time.Millisecond
+		_, err = dialer.Dial()
+		Expect(err).NotTo(BeNil())
+		Expect(err.(net.Error).Timeout()).To(BeTrue())
+	})
+
+	Context("With a circuit breaker", func() {
+		BeforeEach(func() {
+			dialer.Breaker = redix.NewBreaker(2, 50*time.Millisecond)
+		})
+
+		It("Should fail fast while open and close once a probe succeeds.", func() {
+			for i := 0; i < 2; i++ {
+				_, err := dialer.Dial()
+				Expect(err).NotTo(Equal(redix.ErrBackendUnavailable))
+			}
+			Expect(dialer.Breaker.State()).To(Equal(redix.BreakerOpen))
+			_, err := dialer.Dial()
+			Expect(err).To(Equal(redix.ErrBackendUnavailable))
+			Expect(dialer.Stats().Rejected).To(Equal(int64(1)))
+
+			l, err := net.Listen("tcp", addr)
+			Expect(err).To(BeNil())
+			defer l.Close()
+			Eventually(func() error {
+				conn, err := dialer.Dial()
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(Succeed())
+			Expect(dialer.Breaker.State()).To(Equal(redix.BreakerClosed))
+			Expect(dialer.Breaker.Trips()).To(Equal(int64(1)))
+		})
+		It("Should reopen when a probe fails.", func() {
+			dialer.Dial()
+			dialer.Dial()
+			time.Sleep(60 * time.Millisecond)
+			_, err := dialer.Dial()
+			Expect(err).NotTo(Equal(redix.ErrBackendUnavailable))
+			Expect(dialer.Breaker.State()).To(Equal(redix.BreakerOpen))
+			_, err = dialer.Dial()
+			Expect(err).To(Equal(redix.ErrBackendUnavailable))
+		})
+		It("Should neither retry nor trip on a rejected password.", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer l.Close()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					conn.Write([]byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n"))
+					defer conn.Close()
+				}
+			}()
+
+			ip, port, _ := net.SplitHostPort(l.Addr().String())
+			dialer.Reset(ip, port, "wrong")
+			dialer.Attempts = 3
+			for i := 0; i < 3; i++ {
+				_, err = dialer.Dial()
+				Expect(err).To(Equal(redix.ErrInvalidPassword))
+			}
+			Expect(dialer.Stats()).To(Equal(redix.DialStats{Failures: 3}))
+			Expect(dialer.Breaker.State()).To(Equal(redix.BreakerClosed))
+		})
+		It("Should reply to clients that the backend is unavailable.", func() {
+			cfg := redix.DefaultConfig()
+			cfg.Backend = "redis://" + addr
+			cfg.Retry.Attempts = 1
+			cfg.Breaker.Threshold = 1
+			server := redix.NewServer(redix.StaticConfig(cfg))
+			proxyAddr, stop := startProxy(server)
+			defer stop()
+
+			client := dialProxy(proxyAddr)
+			defer client.Close()
+			reply, err := client.reader.ParseObject()
+			Expect(err).To(BeNil())
+			Expect(reply.String()).To(ContainSubstring("connection refused"))
+
+			other := dialProxy(proxyAddr)
+			defer other.Close()
+			reply, err = other.reader.ParseObject()
+			Expect(err).To(BeNil())
+			Expect(reply).To(Equal(redix.Error("ERR backend unavailable")))
+		})
+	})
+})
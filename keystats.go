@@ -0,0 +1,400 @@
+package redix
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Dimensions of the count-min sketch. Estimates exceed the true count by at
+// most 2/sketchWidth of all accesses, with a probability of 1-2^-sketchDepth.
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// A key of a db
+type keyRef struct {
+	db, key string
+}
+
+// HotKey is a key with its estimated number of accesses
+type HotKey struct {
+	DB, Key  string
+	Accesses int64
+}
+
+// BigKey is a key with the largest request and reply seen for it
+type BigKey struct {
+	DB, Key        string
+	Request, Reply int64
+}
+
+func (key BigKey) size() int64 {
+	if key.Request > key.Reply {
+		return key.Request
+	}
+	return key.Reply
+}
+
+// keyStats finds the hottest and the biggest keys. Accesses are sampled
+// into a count-min sketch, whose estimates rank the hottest keys.
+type keyStats struct {
+	// Read by every command without taking the lock: top_k, the bits of
+	// sample_rate, and the size of the smallest big key once there are
+	// top_k of them, below which commands don't take the lock
+	topK, sampleRate uint64
+	bigMin           int64
+
+	mu      sync.Mutex
+	cfg     KeyStatsConfig
+	sketch  [sketchDepth][]uint32
+	hot     map[keyRef]uint32
+	big     map[keyRef]BigKey
+	decayed time.Time
+}
+
+func (stats *keyStats) configure(cfg KeyStatsConfig) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if reflect.DeepEqual(cfg, stats.cfg) {
+		return
+	}
+	stats.cfg = cfg
+	stats.reset()
+	atomic.StoreUint64(&stats.topK, uint64(cfg.TopK))
+	atomic.StoreUint64(&stats.sampleRate, math.Float64bits(cfg.SampleRate))
+}
+
+// Call with the lock held
+func (stats *keyStats) reset() {
+	for i := range stats.sketch {
+		stats.sketch[i] = make([]uint32, sketchWidth)
+	}
+	stats.hot, stats.big = map[keyRef]uint32{}, map[keyRef]BigKey{}
+	stats.decayed = time.Now()
+	atomic.StoreInt64(&stats.bigMin, 0)
+}
+
+func (stats *keyStats) enabled() bool {
+	return atomic.LoadUint64(&stats.topK) > 0
+}
+
+// Counts an access to the keys, unless it is sampled out
+func (stats *keyStats) access(db string, keys []string) {
+	if rate := math.Float64frombits(atomic.LoadUint64(&stats.sampleRate)); rate == 0 || rate < 1 && rand.Float64() >= rate {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.decay(time.Now())
+	for _, key := range keys {
+		ref := keyRef{db, key}
+		count := stats.increment(ref)
+		if _, ok := stats.hot[ref]; ok || len(stats.hot) < stats.cfg.TopK {
+			stats.hot[ref] = count
+			continue
+		}
+		coldest, min := keyRef{}, uint32(0)
+		for other, otherCount := range stats.hot {
+			if min == 0 || otherCount < min {
+				coldest, min = other, otherCount
+			}
+		}
+		if count > min {
+			delete(stats.hot, coldest)
+			stats.hot[ref] = count
+		}
+	}
+}
+
+// Increments the key's counters, only raising those at the minimum as
+// they bound the estimate, and returns its new estimate
+func (stats *keyStats) increment(ref keyRef) uint32 {
+	hash := fnv.New64a()
+	hash.Write([]byte(ref.db + "\x00" + ref.key))
+	sum := hash.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	var cells [sketchDepth]*uint32
+	min := ^uint32(0)
+	for i := range cells {
+		cells[i] = &stats.sketch[i][(h1+uint32(i)*h2)%sketchWidth]
+		if *cells[i] < min {
+			min = *cells[i]
+		}
+	}
+	for _, cell := range cells {
+		if *cell == min {
+			*cell++
+		}
+	}
+	return min + 1
+}
+
+// Halves the counts every decay_interval, so that keys that cool down
+// make way for others. Call with the lock held.
+func (stats *keyStats) decay(now time.Time) {
+	interval := time.Duration(stats.cfg.DecayInterval)
+	if interval <= 0 || now.Sub(stats.decayed) < interval {
+		return
+	}
+	stats.decayed = now
+	for _, row := range stats.sketch {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	for ref, count := range stats.hot {
+		if count /= 2; count == 0 {
+			delete(stats.hot, ref)
+		} else {
+			stats.hot[ref] = count
+		}
+	}
+}
+
+// Records the sizes of the requests and replies of the keys of a command
+func (stats *keyStats) size(db string, keys []string, requests, replies []int64) {
+	bigMin, big := atomic.LoadInt64(&stats.bigMin), false
+	for i := range keys {
+		big = big || requests[i] >= bigMin || replies[i] >= bigMin
+	}
+	if !big {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	for i, key := range keys {
+		ref := keyRef{db, key}
+		entry, ok := stats.big[ref]
+		if !ok {
+			entry = BigKey{DB: db, Key: key}
+		}
+		if requests[i] > entry.Request {
+			entry.Request = requests[i]
+		}
+		if replies[i] > entry.Reply {
+			entry.Reply = replies[i]
+		}
+		if ok || len(stats.big) < stats.cfg.TopK {
+			stats.big[ref] = entry
+			continue
+		}
+		smallest, min := keyRef{}, int64(-1)
+		for other, otherEntry := range stats.big {
+			if min < 0 || otherEntry.size() < min {
+				smallest, min = other, otherEntry.size()
+			}
+		}
+		if entry.size() > min {
+			delete(stats.big, smallest)
+			stats.big[ref] = entry
+		}
+	}
+	if len(stats.big) >= stats.cfg.TopK {
+		min := int64(-1)
+		for _, entry := range stats.big {
+			if min < 0 || entry.size() < min {
+				min = entry.size()
+			}
+		}
+		atomic.StoreInt64(&stats.bigMin, min)
+	}
+}
+
+// HotKeys returns the hottest keys, hottest first, with their accesses
+// estimated from the sampled ones
+func (stats *keyStats) HotKeys() []HotKey {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	keys := make([]HotKey, 0, len(stats.hot))
+	for ref, count := range stats.hot {
+		keys = append(keys, HotKey{DB: ref.db, Key: ref.key, Accesses: int64(float64(count) / stats.cfg.SampleRate)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Accesses != keys[j].Accesses {
+			return keys[i].Accesses > keys[j].Accesses
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// BigKeys returns the biggest keys, biggest first
+func (stats *keyStats) BigKeys() []BigKey {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	keys := make([]BigKey, 0, len(stats.big))
+	for _, entry := range stats.big {
+		keys = append(keys, entry)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].size() != keys[j].size() {
+			return keys[i].size() > keys[j].size()
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// Length of a value in RESP, without encoding it
+func respSize(resp Resp) int64 {
+	header := func(n int) int64 {
+		// Prefix, length and CRLF
+		return int64(len(strconv.Itoa(n))) + 3
+	}
+	switch resp := resp.(type) {
+	case Integer:
+		return int64(len(resp)) + 3
+	case SimpleString:
+		return int64(len(resp)) + 3
+	case Error:
+		return int64(len(resp)) + 3
+	case BulkString:
+		if resp == nil {
+			return 5
+		}
+		return header(len(resp)) + int64(len(resp)) + 2
+	case Array:
+		if resp == nil {
+			return 5
+		}
+		size := header(len(resp))
+		for _, elem := range resp {
+			size += respSize(elem)
+		}
+		return size
+	}
+	return 0
+}
+
+// Sizes of the request and reply of each key of a command. A command with a
+// single key is attributed all of both. Otherwise each key is attributed its
+// own arguments, eg: a key and its value for MSET, and its element of a reply
+// holding one per key, eg: MGET's.
+func keySizes(info CommandInfo, cmd Array, positions []int, reply Resp) (requests, replies []int64) {
+	requests, replies = make([]int64, len(positions)), make([]int64, len(positions))
+	if len(positions) == 1 {
+		requests[0], replies[0] = respSize(cmd), respSize(reply)
+		return requests, replies
+	}
+	array, perKey := reply.(Array)
+	perKey = perKey && len(array) == len(positions)
+	for i, position := range positions {
+		args := cmd[position : position+1]
+		if info.Step > 1 && position+info.Step <= len(cmd) {
+			args = cmd[position : position+info.Step]
+		}
+		for _, arg := range args {
+			requests[i] += respSize(arg)
+		}
+		if perKey {
+			replies[i] = respSize(array[i])
+		}
+	}
+	return requests, replies
+}
+
+// HotKeys returns the hottest keys, hottest first
+func (server *Server) HotKeys() []HotKey {
+	return server.keyStats.HotKeys()
+}
+
+// BigKeys returns the keys with the largest requests or replies
+func (server *Server) BigKeys() []BigKey {
+	return server.keyStats.BigKeys()
+}
+
+// Counts the keys of commands towards hot keys, and the sizes of their
+// requests and replies towards big keys
+func (server *Server) countKeys(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || !server.keyStats.enabled() {
+		return next(ctx, cmd)
+	}
+	info, known := lookupCommand(cmd)
+	if !known {
+		return next(ctx, cmd)
+	}
+	positions, err := info.KeyPositions(cmd)
+	if err != nil || len(positions) == 0 {
+		return next(ctx, cmd)
+	}
+	keys := make([]string, len(positions))
+	for i, position := range positions {
+		keys[i] = cmd[position].String()
+	}
+	db, _ := proxy.session()
+	server.keyStats.access(db, keys)
+	reply, err := next(ctx, cmd)
+	requests, replies := keySizes(info, cmd, positions, reply)
+	server.keyStats.size(db, keys, requests, replies)
+	return reply, err
+}
+
+// Parses the optional count of REDIX HOTKEYS and BIGKEYS
+func keysCount(args Array, total int) (int, error) {
+	if len(args) == 2 {
+		return total, nil
+	}
+	count, err := strconv.Atoi(args[2].String())
+	if len(args) > 3 || err != nil || count < 0 {
+		return 0, errors.New("count should be greater than or equal to 0")
+	}
+	if count > total {
+		count = total
+	}
+	return count, nil
+}
+
+// REDIX HOTKEYS [count]
+func (server *Server) hotKeysCommand(proxy *Proxy, args Array) (Resp, error) {
+	keys := server.HotKeys()
+	count, err := keysCount(args, len(keys))
+	if err != nil {
+		return nil, err
+	}
+	reply := Array{}
+	for _, key := range keys[:count] {
+		reply = append(reply, Array{
+			BulkString(key.Key),
+			BulkString(key.DB),
+			Integer(strconv.FormatInt(key.Accesses, 10)),
+		})
+	}
+	return reply, nil
+}
+
+// REDIX BIGKEYS [count]
+func (server *Server) bigKeysCommand(proxy *Proxy, args Array) (Resp, error) {
+	keys := server.BigKeys()
+	count, err := keysCount(args, len(keys))
+	if err != nil {
+		return nil, err
+	}
+	reply := Array{}
+	for _, key := range keys[:count] {
+		reply = append(reply, Array{
+			BulkString(key.Key),
+			BulkString(key.DB),
+			Integer(strconv.FormatInt(key.Request, 10)),
+			Integer(strconv.FormatInt(key.Reply, 10)),
+		})
+	}
+	return reply, nil
+}
@@ -0,0 +1,94 @@
+package redix_test
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Key stats", func() {
+	var (
+		backend *fakeRedis
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.KeyStats.SampleRate = 1
+		cfg.KeyStats.TopK = 3
+		server := redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	entry := func(key, db string, sizes ...int) redix.Array {
+		entry := redix.Array{redix.BulkString(key), redix.BulkString(db)}
+		for _, size := range sizes {
+			entry = append(entry, redix.Integer(strconv.Itoa(size)))
+		}
+		return entry
+	}
+
+	It("Should find the most accessed keys.", func() {
+		for i := 0; i < 5; i++ {
+			client.Do("GET", "hot:1")
+		}
+		for i := 0; i < 3; i++ {
+			client.Do("GET", "hot:2")
+		}
+		for _, key := range []string{"a", "b", "c", "d"} {
+			client.Do("GET", key)
+		}
+		client.Do("SELECT", "1")
+		client.Do("GET", "hot:2")
+		client.Do("GET", "hot:2")
+
+		Expect(client.Do("REDIX", "HOTKEYS", "2")).To(Equal(redix.Array{
+			entry("hot:1", "0", 5),
+			entry("hot:2", "0", 3),
+		}))
+		Expect(client.Do("REDIX", "HOTKEYS").(redix.Array)).To(ContainElement(entry("hot:2", "1", 2)))
+	})
+
+	It("Should find the keys with the largest requests and replies.", func() {
+		value := strings.Repeat("x", 1000)
+		client.Do("SET", "big", value)
+		client.Do("GET", "big")
+		client.Do("SET", "small", "1")
+
+		request := len(redix.Array{redix.BulkString("SET"), redix.BulkString("big"), redix.BulkString(value)}.Raw())
+		reply := len(redix.BulkString(value).Raw())
+		Expect(client.Do("REDIX", "BIGKEYS", "1")).To(Equal(redix.Array{entry("big", "0", request, reply)}))
+		Expect(client.Do("REDIX", "BIGKEYS").(redix.Array)).To(HaveLen(2))
+	})
+	It("Should attribute sizes to each key of a command.", func() {
+		value := strings.Repeat("x", 1000)
+		client.Do("SET", "big", value)
+		del := []string{"DEL"}
+		for i := 0; i < 100; i++ {
+			del = append(del, "k:"+strconv.Itoa(i))
+		}
+		client.Do(del...)
+
+		request := len(redix.Array{redix.BulkString("SET"), redix.BulkString("big"), redix.BulkString(value)}.Raw())
+		keys := client.Do("REDIX", "BIGKEYS").(redix.Array)
+		Expect(keys).To(HaveLen(3))
+		Expect(keys[0]).To(Equal(entry("big", "0", request, len("+OK\r\n"))))
+		// Its own argument, and no share of the reply
+		Expect(keys[1]).To(Equal(entry("k:10", "0", len(redix.BulkString("k:10").Raw()), 0)))
+	})
+})
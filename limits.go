@@ -0,0 +1,121 @@
+package redix
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var errOutputBufferLimit = errors.New("output buffer limit reached")
+
+// errBackendTimeout is returned by Forward when the backend doesn't reply
+// within timeouts.command
+var errBackendTimeout = errors.New("backend timed out")
+
+// Reports whether a command may legitimately block for longer than
+// timeouts.command. Redis doesn't flag WAIT as blocking, but it waits for
+// replicas.
+func blocking(name string) bool {
+	switch name {
+	case "wait", "waitaof":
+		return true
+	}
+	info, _ := LookupCommand(name)
+	return info.Blocking()
+}
+
+// outputBuffer queues writes in memory for a goroutine to copy to w, so
+// that a client reading slowly doesn't hold up reads from the backend.
+// Writes fail once the queued bytes exceed its limits.
+type outputBuffer struct {
+	w      io.Writer
+	limits OutputBufferConfig
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	buf       []byte
+	pending   int // queued and being written
+	softSince time.Time
+	err       error
+}
+
+func newOutputBuffer(w io.Writer, limits OutputBufferConfig) *outputBuffer {
+	out := &outputBuffer{w: w, limits: limits}
+	out.cond = sync.NewCond(&out.mu)
+	go out.flush()
+	return out
+}
+
+func (out *outputBuffer) Write(p []byte) (int, error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	if out.err != nil {
+		return 0, out.err
+	}
+	out.buf = append(out.buf, p...)
+	out.pending += len(p)
+	if out.exceeded(time.Now()) {
+		out.err = errOutputBufferLimit
+		out.buf = nil
+	}
+	out.cond.Signal()
+	if out.err != nil {
+		return 0, out.err
+	}
+	return len(p), nil
+}
+
+func (out *outputBuffer) exceeded(now time.Time) bool {
+	limits := out.limits
+	if limits.HardBytes > 0 && out.pending > limits.HardBytes {
+		return true
+	}
+	if limits.SoftBytes == 0 || out.pending <= limits.SoftBytes {
+		out.softSince = time.Time{}
+		return false
+	}
+	if out.softSince.IsZero() {
+		out.softSince = now
+	}
+	return now.Sub(out.softSince) > time.Duration(limits.SoftDuration)
+}
+
+// Close stops the flushing goroutine, discarding anything still queued
+func (out *outputBuffer) Close() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	if out.err == nil {
+		out.err = io.ErrClosedPipe
+	}
+	out.buf = nil
+	out.cond.Signal()
+	return nil
+}
+
+func (out *outputBuffer) flush() {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	for {
+		for len(out.buf) == 0 && out.err == nil {
+			out.cond.Wait()
+		}
+		if out.err != nil {
+			return
+		}
+		buf := out.buf
+		out.buf = nil
+
+		out.mu.Unlock()
+		_, err := out.w.Write(buf)
+		out.mu.Lock()
+
+		out.pending -= len(buf)
+		if err != nil && out.err == nil {
+			out.err = err
+		}
+	}
+}
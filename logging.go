@@ -0,0 +1,162 @@
+package redix
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// NewLogger builds the logger described by cfg, writing to w. Its level is
+// held in level so that it can be changed without rebuilding the logger.
+func NewLogger(w io.Writer, cfg LogConfig, level *slog.LevelVar) *slog.Logger {
+	lvl, _ := parseLevel(cfg.Level)
+	level.Set(lvl)
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// Logs every command at debug level, sampled at log.sample_rate
+func (server *Server) logCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || !proxy.Logger.Enabled(ctx, slog.LevelDebug) {
+		return next(ctx, cmd)
+	}
+	if rate := server.Configs.Config().Log.SampleRate; rate < 1 && rand.Float64() >= rate {
+		return next(ctx, cmd)
+	}
+
+	start := time.Now()
+	reply, err := next(ctx, cmd)
+	attrs := []any{
+		"cmd", redact(cmd).HumanReadable(),
+		"duration", time.Since(start),
+	}
+	switch r := reply.(type) {
+	case nil:
+	case Error:
+		attrs = append(attrs, "reply", "error", "error", r.String())
+	default:
+		attrs = append(attrs, "reply", replyType(r))
+	}
+	if err != nil && err != ErrCloseClient {
+		attrs = append(attrs, "error", err.Error())
+	}
+	proxy.Logger.DebugContext(ctx, "command", attrs...)
+	return reply, err
+}
+
+const redacted = "(redacted)"
+
+// Backend config params holding passwords
+var backendSecretParams = map[string]bool{
+	"requirepass": true,
+	"masterauth":  true,
+}
+
+// redact returns a copy of cmd with any credentials replaced, so
+// that it is safe to log
+func redact(cmd Array) Array {
+	safe := make(Array, len(cmd))
+	copy(safe, cmd)
+
+	switch strings.ToLower(cmd[0].String()) {
+	case "auth":
+		// AUTH [username] password
+		for i := 1; i < len(safe); i++ {
+			safe[i] = BulkString(redacted)
+		}
+	case "hello":
+		// HELLO protover AUTH username password
+		redactAfter(safe, "auth", 2)
+	case "migrate":
+		// MIGRATE ... AUTH password | AUTH2 username password
+		redactAfter(safe, "auth", 1)
+		redactAfter(safe, "auth2", 2)
+	case "promote":
+		// PROMOTE slave [auth] timeout
+		if len(safe) == 4 {
+			safe[2] = BulkString(redacted)
+		}
+	case "config":
+		// CONFIG SET param value [param value ...]
+		if len(safe) > 2 && strings.EqualFold(safe[1].String(), "set") {
+			for i := 2; i+1 < len(safe); i += 2 {
+				if backendSecretParams[strings.ToLower(safe[i].String())] {
+					safe[i+1] = BulkString(redacted)
+				}
+			}
+		}
+	case "acl":
+		// ACL SETUSER username [rule ...], where >pass, <pass, #hash and
+		// !hash rules hold passwords
+		if len(safe) > 2 && strings.EqualFold(safe[1].String(), "setuser") {
+			for i := 3; i < len(safe); i++ {
+				if rule := safe[i].String(); rule != "" && strings.ContainsRune("><#!", rune(rule[0])) {
+					safe[i] = BulkString(rule[:1] + redacted)
+				}
+			}
+		}
+	case "redix":
+		// REDIX CONFIG SET param value
+		if len(safe) == 5 && strings.EqualFold(safe[1].String(), "config") && strings.EqualFold(safe[2].String(), "set") {
+			param := strings.ToLower(safe[3].String())
+			if secretParams[param] || strings.HasPrefix(param, "auth.") {
+				safe[4] = BulkString(redacted)
+			} else {
+				safe[4] = BulkString(stripUserinfo(safe[4].String()))
+			}
+		}
+	}
+	return safe
+}
+
+// Redacts the n args following each occurrence of token
+func redactAfter(args Array, token string, n int) {
+	for i := 1; i < len(args); i++ {
+		if !strings.EqualFold(args[i].String(), token) {
+			continue
+		}
+		for j := 0; j < n && i+1 < len(args); j++ {
+			i++
+			args[i] = BulkString(redacted)
+		}
+	}
+}
+
+func replyType(reply Resp) string {
+	switch r := reply.(type) {
+	case Integer:
+		return "integer"
+	case SimpleString:
+		return "status"
+	case Error:
+		return "error"
+	case BulkString:
+		if r == nil {
+			return "nil"
+		}
+		return "bulk"
+	case Array:
+		if r == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("array[%d]", len(r))
+	default:
+		return "unknown"
+	}
+}
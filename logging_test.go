@@ -0,0 +1,135 @@
+package redix_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Collects log lines written concurrently by connections
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var entry map[string]interface{}
+		Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed())
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+var _ = Describe("Logging", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		client  *testClient
+		logs    *syncBuffer
+	)
+
+	commandLogs := func() []map[string]interface{} {
+		var commands []map[string]interface{}
+		for _, line := range logs.Lines() {
+			if line["msg"] == "command" {
+				commands = append(commands, line)
+			}
+		}
+		return commands
+	}
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Log.Level = "debug"
+		cfg.Log.Format = "json"
+		server = redix.NewServer(redix.StaticConfig(cfg))
+		logs = &syncBuffer{}
+		server.Logger = redix.NewLogger(logs, cfg.Log, &slog.LevelVar{})
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	It("Should log commands with connection ids.", func() {
+		client.Do("GET", "foo")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0]["level"]).To(Equal("DEBUG"))
+		Expect(commands[0]["cmd"]).To(Equal(`"GET" "foo"`))
+		Expect(commands[0]["reply"]).To(Equal("nil"))
+		Expect(commands[0]["client_id"]).To(BeNumerically(">", 0))
+		Expect(commands[0]["conn_id"]).To(BeNumerically(">", 0))
+		Expect(commands[0]["client_addr"]).To(Equal(client.conn.LocalAddr().String()))
+	})
+	It("Should redact credentials.", func() {
+		client.Do("AUTH", "user", "hunter2")
+		client.Do("HELLO", "2", "AUTH", "user", "hunter2", "SETNAME", "app")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(2))
+		Expect(commands[0]["cmd"]).To(Equal(`"AUTH" "(redacted)" "(redacted)"`))
+		Expect(commands[1]["cmd"]).To(Equal(`"HELLO" "2" "AUTH" "(redacted)" "(redacted)" "SETNAME" "app"`))
+	})
+	It("Should redact the auth of promotions.", func() {
+		client.Do("PROMOTE", "10.0.0.2:6379", "hunter2", "1000")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0]["cmd"]).To(Equal(`"PROMOTE" "10.0.0.2:6379" "(redacted)" "1000"`))
+	})
+	It("Should redact passwords set on the backend.", func() {
+		client.Do("CONFIG", "SET", "maxmemory", "1gb", "requirepass", "hunter2", "MASTERAUTH", "hunter2")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0]["cmd"]).To(Equal(`"CONFIG" "SET" "maxmemory" "1gb" "requirepass" "(redacted)" "MASTERAUTH" "(redacted)"`))
+	})
+	It("Should redact the passwords of ACL users.", func() {
+		client.Do("ACL", "SETUSER", "app", "on", ">hunter2", "<hunter3", "#abc123", "!def456", "~app:*", "+@read")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(1))
+		Expect(commands[0]["cmd"]).To(Equal(`"ACL" "SETUSER" "app" "on" ">(redacted)" "<(redacted)" "#(redacted)" "!(redacted)" "~app:*" "+@read"`))
+	})
+	It("Should redact credentials set at runtime.", func() {
+		client.Do("REDIX", "CONFIG", "SET", "auth.password", "hunter2")
+		client.Do("REDIX", "CONFIG", "SET", "mirror.backend", "redis://:hunter2@10.0.0.1:6379")
+
+		commands := commandLogs()
+		Expect(commands).To(HaveLen(2))
+		Expect(commands[0]["cmd"]).To(Equal(`"REDIX" "CONFIG" "SET" "auth.password" "(redacted)"`))
+		Expect(commands[1]["cmd"]).To(Equal(`"REDIX" "CONFIG" "SET" "mirror.backend" "redis://10.0.0.1:6379"`))
+	})
+	It("Should sample command logs.", func() {
+		Expect(server.Configs.Update(func(cfg *redix.Config) { cfg.Log.SampleRate = 0 })).To(Succeed())
+		client.Do("GET", "foo")
+		Expect(commandLogs()).To(BeEmpty())
+	})
+})
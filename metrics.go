@@ -0,0 +1,219 @@
+package redix
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+)
+
+// Metrics are the Prometheus metrics of a Server. They are kept in their
+// own registry, served by Handler.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	Commands   *prometheus.CounterVec
+	Latency    *prometheus.HistogramVec
+	Errors     *prometheus.CounterVec
+	BytesIn    prometheus.Counter
+	BytesOut   prometheus.Counter
+	Promotions *prometheus.CounterVec
+	Coalesced  *prometheus.CounterVec
+}
+
+func newMetrics(server *Server) *Metrics {
+	metrics := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		Commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redix_commands_total",
+			Help: "Commands handled by the proxy, by command name.",
+		}, []string{"command"}),
+		Latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "redix_command_duration_seconds",
+			Help:    "Time to handle a command, including the backend round trip.",
+			Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"command"}),
+		Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redix_errors_total",
+			Help: "Error replies sent to clients, by error prefix.",
+		}, []string{"prefix"}),
+		BytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "redix_client_read_bytes_total",
+			Help: "Bytes read from clients.",
+		}),
+		BytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "redix_client_written_bytes_total",
+			Help: "Bytes written to clients.",
+		}),
+		Promotions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redix_promotions_total",
+			Help: "PROMOTE attempts, by outcome.",
+		}, []string{"outcome"}),
+		Coalesced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redix_coalesced_commands_total",
+			Help: "Commands answered with the reply to an identical command in flight, by command name.",
+		}, []string{"command"}),
+	}
+
+	metrics.Registry.MustRegister(
+		metrics.Commands,
+		metrics.Latency,
+		metrics.Errors,
+		metrics.BytesIn,
+		metrics.BytesOut,
+		metrics.Promotions,
+		metrics.Coalesced,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "redix_connected_clients",
+			Help: "Client connections currently open.",
+		}, func() float64 { return float64(server.NumClients()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "redix_backend_connections",
+			Help: "Backend connections currently open.",
+		}, func() float64 { return float64(server.Conns.Len()) }),
+		backendCollector{server: server},
+	)
+	dialer := server.Dialer
+	for outcome, count := range map[string]func(DialStats) int64{
+		"success":  func(stats DialStats) int64 { return stats.Successes },
+		"failure":  func(stats DialStats) int64 { return stats.Failures },
+		"rejected": func(stats DialStats) int64 { return stats.Rejected },
+	} {
+		count := count
+		metrics.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "redix_backend_dials_total",
+			Help:        "Attempts to connect to the backend, by outcome. Rejected attempts were failed fast by the circuit breaker.",
+			ConstLabels: prometheus.Labels{"outcome": outcome},
+		}, func() float64 { return float64(count(dialer.Stats())) }))
+	}
+	metrics.Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "redix_backend_dial_retries_total",
+			Help: "Backend connection attempts that were retried.",
+		}, func() float64 { return float64(dialer.Stats().Retries) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "redix_backend_breaker_state",
+			Help: "State of the backend circuit breaker: 0 closed, 1 open, 2 half-open.",
+		}, func() float64 { return float64(dialer.Breaker.State()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "redix_backend_breaker_trips_total",
+			Help: "Times the backend circuit breaker opened.",
+		}, func() float64 { return float64(dialer.Breaker.Trips()) }),
+	)
+	mirror := &server.mirror
+	for outcome, count := range map[string]func(MirrorStats) int64{
+		"replied": func(stats MirrorStats) int64 { return stats.Replied },
+		"error":   func(stats MirrorStats) int64 { return stats.Errors },
+		"failed":  func(stats MirrorStats) int64 { return stats.Failed },
+		"dropped": func(stats MirrorStats) int64 { return stats.Dropped },
+	} {
+		count := count
+		metrics.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "redix_mirror_commands_total",
+			Help:        "Commands copied to the mirror, by outcome: replied, error reply, failed connection, or dropped because the mirror fell behind.",
+			ConstLabels: prometheus.Labels{"outcome": outcome},
+		}, func() float64 { return float64(count(mirror.Stats())) }))
+	}
+	metrics.Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "redix_mirror_compared_total",
+			Help: "Replies of the mirror compared with the primary's.",
+		}, func() float64 { return float64(mirror.Stats().Compared) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "redix_mirror_mismatches_total",
+			Help: "Replies of the mirror that differed from the primary's.",
+		}, func() float64 { return float64(mirror.Stats().Mismatched) }),
+	)
+	migration := &server.migration
+	for outcome, count := range map[string]func(MigrationStats) int64{
+		"copied": func(stats MigrationStats) int64 { return stats.Copied },
+		"failed": func(stats MigrationStats) int64 { return stats.Failed },
+	} {
+		count := count
+		metrics.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "redix_migration_keys_total",
+			Help:        "Keys copied to the migration target, by outcome.",
+			ConstLabels: prometheus.Labels{"outcome": outcome},
+		}, func() float64 { return float64(count(migration.Stats())) }))
+	}
+	return metrics
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})
+}
+
+// Interceptor counts and times every command and its errors
+func (metrics *Metrics) Interceptor(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	name := commandLabel(cmd)
+	start := time.Now()
+	reply, err := next(ctx, cmd)
+	metrics.Commands.WithLabelValues(name).Inc()
+	metrics.Latency.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if e, ok := reply.(Error); ok {
+		metrics.Errors.WithLabelValues(errorPrefix(e)).Inc()
+	} else if err != nil && err != ErrCloseClient {
+		metrics.Errors.WithLabelValues("ERR").Inc()
+	}
+	return reply, err
+}
+
+// Keeps label cardinality bounded when clients send garbage: commands
+// missing from the command table, other than the proxy's own, are "other"
+func commandLabel(cmd Array) string {
+	name := strings.ToLower(cmd[0].String())
+	if _, known := LookupCommand(name); known || name == "redix" || name == "promote" {
+		return name
+	}
+	return "other"
+}
+
+func errorPrefix(e Error) string {
+	prefix := strings.SplitN(e.String(), " ", 2)[0]
+	if len(prefix) > 32 {
+		return "other"
+	}
+	return prefix
+}
+
+// Exports the backend new connections are made to as a label
+type backendCollector struct {
+	server *Server
+}
+
+var backendDesc = prometheus.NewDesc(
+	"redix_backend_info",
+	"The backend that new connections are made to.",
+	[]string{"addr"}, nil,
+)
+
+func (collector backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendDesc
+}
+
+func (collector backendCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(backendDesc, prometheus.GaugeValue, 1, collector.server.Dialer.Addr())
+}
+
+// Counts the bytes read from and written to a client
+type countingConn struct {
+	net.Conn
+	in, out prometheus.Counter
+}
+
+func (conn countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.in.Add(float64(n))
+	return n, err
+}
+
+func (conn countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.out.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,70 @@
+package redix_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		server.Metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body, err := ioutil.ReadAll(rec.Body)
+		Expect(err).To(BeNil())
+		return string(body)
+	}
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		server = redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	It("Should count commands and errors.", func() {
+		client.Do("SET", "foo", "bar")
+		client.Do("GET", "foo")
+		client.Do("GET", "foo")
+		client.Do("NOPE")
+
+		metrics := scrape()
+		Expect(metrics).To(ContainSubstring(`redix_commands_total{command="get"} 2`))
+		Expect(metrics).To(ContainSubstring(`redix_commands_total{command="set"} 1`))
+		Expect(metrics).To(ContainSubstring(`redix_errors_total{prefix="ERR"} 1`))
+		Expect(metrics).To(ContainSubstring(`redix_command_duration_seconds_count{command="get"} 2`))
+		// Unknown commands share a label
+		Expect(metrics).To(ContainSubstring(`redix_commands_total{command="other"} 1`))
+		Expect(metrics).NotTo(ContainSubstring(`command="nope"`))
+	})
+	It("Should report connections and the backend.", func() {
+		client.Do("PING")
+
+		metrics := scrape()
+		Expect(metrics).To(ContainSubstring("redix_connected_clients 1"))
+		Expect(metrics).To(ContainSubstring("redix_backend_connections 1"))
+		Expect(metrics).To(ContainSubstring(`redix_backend_info{addr="` + backend.l.Addr().String() + `"} 1`))
+		Expect(metrics).To(MatchRegexp(`redix_client_read_bytes_total [1-9]`))
+		Expect(metrics).To(MatchRegexp(`redix_client_written_bytes_total [1-9]`))
+	})
+})
@@ -13,6 +13,11 @@ type Conn struct {
 	mgr *ConnectionManager
 }
 
+// ID returns the id the connection was given by the ConnectionManager
+func (conn *Conn) ID() int {
+	return conn.id
+}
+
 // Closes and removes itself from the ConnectionManager
 func (conn *Conn) Close() error {
 	conn.mgr.mu.Lock()
@@ -48,6 +53,14 @@ func (mgr *ConnectionManager) Add(conn net.Conn) net.Conn {
 	return &Conn{Conn: conn, id: id, mgr: mgr}
 }
 
+// Len returns the number of open connections
+func (mgr *ConnectionManager) Len() int {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+
+	return len(mgr.conns)
+}
+
 func (mgr *ConnectionManager) CloseAll() {
 	mgr.mu.Lock()
 	defer mgr.mu.Unlock()
@@ -0,0 +1,68 @@
+package redix
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Handler produces the reply to a command
+type Handler func(ctx context.Context, cmd Array) (Resp, error)
+
+// Interceptor runs around the handling of a command. It may inspect or
+// rewrite cmd before calling next, inspect or replace the reply after it,
+// or reply without calling next at all. The Proxy the command came from is
+// available through ProxyFromContext.
+type Interceptor func(ctx context.Context, cmd Array, next Handler) (Resp, error)
+
+type route struct {
+	names        map[string]bool
+	interceptors []Interceptor
+}
+
+type proxyKey struct{}
+
+// ProxyFromContext returns the Proxy handling the command, if any
+func ProxyFromContext(ctx context.Context) (*Proxy, bool) {
+	proxy, ok := ctx.Value(proxyKey{}).(*Proxy)
+	return proxy, ok
+}
+
+func withProxy(ctx context.Context, proxy *Proxy) context.Context {
+	return context.WithValue(ctx, proxyKey{}, proxy)
+}
+
+// Use appends interceptors that run for every command. Interceptors run in
+// the order they were added, the first being the outermost. Use must not be
+// called once the server is serving.
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.routes = append(server.routes, route{interceptors: interceptors})
+}
+
+// UseFor is like Use, but the interceptors only run for the named commands.
+// They are ordered along with those added by Use.
+func (server *Server) UseFor(names []string, interceptors ...Interceptor) {
+	r := route{names: map[string]bool{}, interceptors: interceptors}
+	for _, name := range names {
+		r.names[strings.ToLower(name)] = true
+	}
+	server.routes = append(server.routes, r)
+}
+
+// Builds the interceptor chain for a command around the final handler
+func (server *Server) chain(name string, final Handler) Handler {
+	var interceptors []Interceptor
+	for _, r := range server.routes {
+		if r.names == nil || r.names[name] {
+			interceptors = append(interceptors, r.interceptors...)
+		}
+	}
+	handler := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, cmd Array) (Resp, error) {
+			return interceptor(ctx, cmd, next)
+		}
+	}
+	return handler
+}
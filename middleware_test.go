@@ -0,0 +1,95 @@
+package redix_test
+
+import (
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Interceptors", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		client  *testClient
+		calls   []string
+	)
+
+	// Records its name on the way in and out
+	trace := func(name string) redix.Interceptor {
+		return func(ctx context.Context, cmd redix.Array, next redix.Handler) (redix.Resp, error) {
+			calls = append(calls, name+">")
+			reply, err := next(ctx, cmd)
+			calls = append(calls, "<"+name)
+			return reply, err
+		}
+	}
+
+	BeforeEach(func() {
+		calls = nil
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		server = redix.NewServer(redix.StaticConfig(cfg))
+	})
+
+	JustBeforeEach(func() {
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	Context("Ordering", func() {
+		BeforeEach(func() {
+			server.Use(trace("a"), trace("b"))
+			server.UseFor([]string{"get"}, trace("get"))
+			server.Use(trace("c"))
+		})
+
+		It("Should run in the order added.", func() {
+			client.Do("PING")
+			Expect(calls).To(Equal([]string{"a>", "b>", "c>", "<c", "<b", "<a"}))
+		})
+		It("Should only run routed interceptors for their commands.", func() {
+			client.Do("GET", "foo")
+			Expect(calls).To(Equal([]string{"a>", "b>", "get>", "c>", "<c", "<get", "<b", "<a"}))
+		})
+	})
+
+	Context("Rewriting", func() {
+		BeforeEach(func() {
+			server.Use(func(ctx context.Context, cmd redix.Array, next redix.Handler) (redix.Resp, error) {
+				// Runs in the server's goroutine
+				defer GinkgoRecover()
+				proxy, ok := redix.ProxyFromContext(ctx)
+				Expect(ok).To(BeTrue())
+				Expect(proxy.ClientAddr()).To(Equal(client.conn.LocalAddr().String()))
+				return next(ctx, append(redix.Array{redix.BulkString("ECHO")}, cmd[1:]...))
+			})
+			server.UseFor([]string{"blocked"}, func(ctx context.Context, cmd redix.Array, next redix.Handler) (redix.Resp, error) {
+				return redix.Error("BLOCKED not allowed"), nil
+			})
+			server.UseFor([]string{"empty"}, func(ctx context.Context, cmd redix.Array, next redix.Handler) (redix.Resp, error) {
+				return next(ctx, redix.Array{})
+			})
+		})
+
+		It("Should allow rewriting commands.", func() {
+			Expect(client.Do("ANYTHING", "hi").String()).To(Equal("hi"))
+		})
+		It("Should allow replying without calling next.", func() {
+			Expect(client.Do("BLOCKED", "hi")).To(Equal(redix.Error("BLOCKED not allowed")))
+		})
+		It("Should reject commands rewritten to nothing.", func() {
+			Expect(client.Do("EMPTY")).To(Equal(redix.Error("ERR empty command")))
+			Expect(client.Do("ANYTHING", "hi").String()).To(Equal("hi"))
+		})
+	})
+})
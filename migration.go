@@ -0,0 +1,573 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// Attempts to copy a key before it is given up on
+	migrationAttempts = 3
+	// Wait between attempts
+	migrationRetry = time.Second
+	// A backend taking longer to reply is disconnected
+	migrationReplyTimeout = 10 * time.Second
+)
+
+// A key to copy from the old backend to the target
+type migrationItem struct {
+	db, key string
+}
+
+// MigrationStats describes the progress of a migration
+type MigrationStats struct {
+	// Address of the target, empty if there is no migration
+	Target string
+	// State of REDIX MIGRATE COPY: idle, running, done or failed
+	Copy string
+	// Keys found by the copy
+	Scanned int64
+	// Keys copied or deleted on the target, and those given up on
+	Copied, Failed int64
+	// Keys waiting to be copied
+	Pending int64
+}
+
+// migration applies the writes made through the proxy to a new backend,
+// by copying the keys they wrote once they are done
+type migration struct {
+	mu      sync.RWMutex
+	cfg     MigrationConfig
+	backend string
+	run     *migrationRun
+	logger  *slog.Logger
+}
+
+func (migration *migration) configure(cfg MigrationConfig, backend string, timeouts TimeoutsConfig, logger *slog.Logger) {
+	migration.mu.Lock()
+	defer migration.mu.Unlock()
+
+	if reflect.DeepEqual(cfg, migration.cfg) && backend == migration.backend {
+		return
+	}
+	if migration.run != nil {
+		migration.run.close()
+		migration.run = nil
+	}
+	migration.cfg, migration.backend, migration.logger = cfg, backend, logger
+	if cfg.Target == "" {
+		return
+	}
+	dialer := func(url string) *Dialer {
+		ip, port, auth, _ := ParseRedisURL(url)
+		return &Dialer{IP: ip, Port: port, Auth: auth, Timeout: time.Duration(timeouts.Connect), AuthTimeout: time.Duration(timeouts.Auth)}
+	}
+	migration.run = newMigrationRun(cfg, dialer(backend), dialer(cfg.Target), logger)
+}
+
+func (migration *migration) close() {
+	migration.configure(MigrationConfig{}, "", TimeoutsConfig{}, nil)
+}
+
+// Returns the migration in progress, if any
+func (migration *migration) current() *migrationRun {
+	migration.mu.RLock()
+	defer migration.mu.RUnlock()
+	return migration.run
+}
+
+// Ends the migration, unless another one has replaced it
+func (migration *migration) end(run *migrationRun) {
+	migration.mu.Lock()
+	defer migration.mu.Unlock()
+	if migration.run == run {
+		run.close()
+		migration.run = nil
+		migration.cfg.Target = ""
+	}
+}
+
+func (migration *migration) Stats() MigrationStats {
+	if run := migration.current(); run != nil {
+		return run.Stats()
+	}
+	return MigrationStats{Copy: "idle"}
+}
+
+// A migration to one target. Keys are copied by workers, each of which owns
+// the keys hashing to it, so that copies of a key are made in order.
+type migrationRun struct {
+	cfg    MigrationConfig
+	source *Dialer
+	target *Dialer
+	logger *slog.Logger
+	queues []chan migrationItem
+	stop   chan struct{}
+
+	// Held by writes until the keys they wrote are queued, and by the
+	// cutover while it waits for them to be copied
+	writes sync.RWMutex
+	// For writes without keys, such as FLUSHDB
+	direct struct {
+		sync.Mutex
+		conn migrationConn
+	}
+
+	// State of REDIX MIGRATE COPY, see MigrationStats
+	copyMu    sync.Mutex
+	copyState string
+
+	scanned, copied, failed, pending int64
+}
+
+func newMigrationRun(cfg MigrationConfig, source, target *Dialer, logger *slog.Logger) *migrationRun {
+	run := &migrationRun{cfg: cfg, source: source, target: target, logger: logger, stop: make(chan struct{}), copyState: "idle"}
+	run.direct.conn.dialer = target
+	for i := 0; i < cfg.Workers; i++ {
+		queue := make(chan migrationItem, cfg.QueueSize/cfg.Workers+1)
+		run.queues = append(run.queues, queue)
+		worker := &migrationWorker{run: run, source: migrationConn{dialer: source}, target: migrationConn{dialer: target}}
+		go worker.work(queue)
+	}
+	return run
+}
+
+func (run *migrationRun) close() {
+	close(run.stop)
+	run.direct.Lock()
+	defer run.direct.Unlock()
+	run.direct.conn.close()
+}
+
+func (run *migrationRun) Stats() MigrationStats {
+	return MigrationStats{
+		Target:  net.JoinHostPort(run.target.IP, run.target.Port),
+		Copy:    run.copyStatus(),
+		Scanned: atomic.LoadInt64(&run.scanned),
+		Copied:  atomic.LoadInt64(&run.copied),
+		Failed:  atomic.LoadInt64(&run.failed),
+		Pending: atomic.LoadInt64(&run.pending),
+	}
+}
+
+// Queues a key to be copied, waiting for room in the queue unless the
+// migration stops
+func (run *migrationRun) enqueue(db, key string) {
+	hash := fnv.New32a()
+	hash.Write([]byte(db + "\x00" + key))
+	atomic.AddInt64(&run.pending, 1)
+	select {
+	case run.queues[hash.Sum32()%uint32(len(run.queues))] <- migrationItem{db: db, key: key}:
+	case <-run.stop:
+		atomic.AddInt64(&run.pending, -1)
+	}
+}
+
+// Applies a write made through the proxy to the target
+func (run *migrationRun) write(db string, info CommandInfo, cmd Array) {
+	select {
+	case <-run.stop:
+		// Cut over, or replaced
+		return
+	default:
+	}
+	keys, err := info.Keys(cmd)
+	switch {
+	case err != nil:
+		atomic.AddInt64(&run.failed, 1)
+		run.logger.Warn("migration: unable to find the keys written", "command", info.Name)
+	case len(keys) == 0 && info.InCategory("@keyspace"):
+		// FLUSHALL, FLUSHDB, SWAPDB
+		run.direct.Lock()
+		defer run.direct.Unlock()
+		if _, err := run.direct.conn.do(db, cmd); err != nil {
+			atomic.AddInt64(&run.failed, 1)
+			run.logger.Error("migration: unable to apply write to target", "command", info.Name, "error", err)
+		}
+	default:
+		for _, key := range keys {
+			run.enqueue(db, key)
+		}
+	}
+}
+
+// Waits for the keys queued to be copied
+func (run *migrationRun) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&run.pending) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Returns why the target may be missing keys, if it may
+func (run *migrationRun) checkCutover() error {
+	if state := run.copyStatus(); state != "done" {
+		return fmt.Errorf("the copy of the existing keys is %s, run REDIX MIGRATE COPY or use FORCE", state)
+	}
+	if failed := atomic.LoadInt64(&run.failed); failed > 0 {
+		return fmt.Errorf("%d keys failed to be copied, copy them again or use FORCE", failed)
+	}
+	return nil
+}
+
+// Queues every key of the old backend to be copied, unless a copy is
+// already running
+func (run *migrationRun) startCopy() bool {
+	run.copyMu.Lock()
+	defer run.copyMu.Unlock()
+	if run.copyState == "running" {
+		return false
+	}
+	run.copyState = "running"
+	go func() {
+		if err := run.copyKeys(); err != nil {
+			run.setCopyStatus("failed")
+			run.logger.Error("migration: copy failed", "error", err)
+			return
+		}
+		run.setCopyStatus("done")
+	}()
+	return true
+}
+
+func (run *migrationRun) copyStatus() string {
+	run.copyMu.Lock()
+	defer run.copyMu.Unlock()
+	return run.copyState
+}
+
+func (run *migrationRun) setCopyStatus(state string) {
+	run.copyMu.Lock()
+	defer run.copyMu.Unlock()
+	run.copyState = state
+}
+
+func (run *migrationRun) copyKeys() error {
+	conn := migrationConn{dialer: run.source}
+	defer conn.close()
+
+	replies, err := conn.do("0", Array{BulkString("INFO"), BulkString("keyspace")})
+	if err != nil {
+		return err
+	}
+	// Lines of the form db0:keys=1,expires=0,avg_ttl=0
+	var dbs []string
+	for _, line := range strings.Split(replies[0].String(), "\r\n") {
+		if strings.HasPrefix(line, "db") && strings.Contains(line, ":") {
+			dbs = append(dbs, line[2:strings.IndexByte(line, ':')])
+		}
+	}
+	count := BulkString(strconv.Itoa(run.cfg.BatchSize))
+	for _, db := range dbs {
+		cursor := BulkString("0")
+		for {
+			replies, err := conn.do(db, Array{BulkString("SCAN"), cursor, BulkString("COUNT"), count})
+			if err != nil {
+				return err
+			}
+			page, ok := replies[0].(Array)
+			if !ok || len(page) != 2 {
+				return errors.New("unexpected reply to SCAN: " + replies[0].HumanReadable())
+			}
+			keys, _ := page[1].(Array)
+			for _, key := range keys {
+				atomic.AddInt64(&run.scanned, 1)
+				run.enqueue(db, key.String())
+			}
+			select {
+			case <-run.stop:
+				return errors.New("migration stopped")
+			default:
+			}
+			if cursor = BulkString(page[0].String()); cursor.String() == "0" {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+type migrationWorker struct {
+	run            *migrationRun
+	source, target migrationConn
+}
+
+func (worker *migrationWorker) work(queue chan migrationItem) {
+	defer worker.source.close()
+	defer worker.target.close()
+	for {
+		select {
+		case item := <-queue:
+			worker.copyKey(item)
+			atomic.AddInt64(&worker.run.pending, -1)
+		case <-worker.run.stop:
+			return
+		}
+	}
+}
+
+// Copies a key with its TTL, retrying a few times
+func (worker *migrationWorker) copyKey(item migrationItem) {
+	for attempt := 1; ; attempt++ {
+		err := worker.copy(item)
+		if err == nil {
+			atomic.AddInt64(&worker.run.copied, 1)
+			return
+		}
+		if attempt == migrationAttempts {
+			atomic.AddInt64(&worker.run.failed, 1)
+			worker.run.logger.Error("migration: unable to copy key", "db", item.db, "key", item.key, "error", err)
+			return
+		}
+		select {
+		case <-time.After(migrationRetry):
+		case <-worker.run.stop:
+			return
+		}
+	}
+}
+
+// Restores the key's current value on the target, or deletes it there if
+// it no longer exists
+func (worker *migrationWorker) copy(item migrationItem) error {
+	key := BulkString(item.key)
+	replies, err := worker.source.do(item.db, Array{BulkString("PTTL"), key}, Array{BulkString("DUMP"), key})
+	if err != nil {
+		return err
+	}
+	cmd := Array{BulkString("DEL"), key}
+	switch dump := replies[1].(type) {
+	case Error:
+		return errors.New(dump.String())
+	case BulkString:
+		if dump != nil {
+			ttl, _ := strconv.ParseInt(replies[0].String(), 10, 64)
+			if ttl < 0 {
+				// No expiry
+				ttl = 0
+			}
+			cmd = Array{BulkString("RESTORE"), key, BulkString(strconv.FormatInt(ttl, 10)), dump, BulkString("REPLACE")}
+		}
+	}
+	replies, err = worker.target.do(item.db, cmd)
+	if err != nil {
+		return err
+	}
+	if reply, ok := replies[0].(Error); ok {
+		return errors.New(reply.String())
+	}
+	return nil
+}
+
+// A connection used by the migration, dialed on first use and after
+// failures
+type migrationConn struct {
+	dialer *Dialer
+	conn   net.Conn
+	reader *RESPReader
+	db     string
+}
+
+// Sends the commands to the db in a single write and returns their replies
+func (conn *migrationConn) do(db string, cmds ...Array) ([]Resp, error) {
+	if conn.conn == nil {
+		netConn, err := conn.dialer.Dial()
+		if err != nil {
+			return nil, err
+		}
+		conn.conn, conn.reader, conn.db = netConn, NewReader(netConn), "0"
+	}
+	selecting := db != conn.db
+	if selecting {
+		cmds = append([]Array{{BulkString("SELECT"), BulkString(db)}}, cmds...)
+	}
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, cmd.Raw()...)
+	}
+	conn.conn.SetDeadline(time.Now().Add(migrationReplyTimeout))
+	if _, err := conn.conn.Write(buf); err != nil {
+		conn.close()
+		return nil, err
+	}
+	replies := make([]Resp, len(cmds))
+	for i := range cmds {
+		reply, err := conn.reader.ParseObject()
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	if selecting {
+		if reply, ok := replies[0].(Error); ok {
+			return nil, errors.New(reply.String())
+		}
+		conn.db, replies = db, replies[1:]
+	}
+	return replies, nil
+}
+
+func (conn *migrationConn) close() {
+	if conn.conn != nil {
+		conn.conn.Close()
+		conn.conn = nil
+	}
+}
+
+// MigrationStats describes the migration in progress
+func (server *Server) MigrationStats() MigrationStats {
+	return server.migration.Stats()
+}
+
+// Switches the proxy to the migration target once the keys written through
+// the proxy have been copied. As with PROMOTE, clients are disconnected and
+// new connections wait until the switch is done. Unless forced, the existing
+// keys must have been copied by REDIX MIGRATE COPY, and none may have failed
+// to be copied.
+func (server *Server) Cutover(timeout time.Duration, force bool) error {
+	run := server.migration.current()
+	if run == nil {
+		return errors.New("no migration in progress")
+	}
+	if !force {
+		if err := run.checkCutover(); err != nil {
+			return err
+		}
+	}
+	err := func() error {
+		server.Dialer.mu.Lock()
+		defer server.Dialer.mu.Unlock()
+
+		server.Conns.CloseAll()
+		run.writes.Lock()
+		defer run.writes.Unlock()
+		if !run.drain(timeout) {
+			return errors.New("timed out waiting for keys to be copied")
+		}
+		// Keys may have failed to be copied while draining
+		if !force {
+			if err := run.checkCutover(); err != nil {
+				return err
+			}
+		}
+		server.Dialer.Reset(run.target.IP, run.target.Port, run.target.Auth)
+		// Copying from the old backend would now overwrite newer writes
+		server.migration.end(run)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	server.Logger.Info("migration: cut over", "backend", server.Dialer.Addr())
+
+	// Keep the config in line, so that REDIX CONFIG REWRITE persists it
+	err = server.Configs.Update(func(cfg *Config) {
+		cfg.Backend = run.cfg.Target
+		cfg.Migration.Target = ""
+	})
+	if err != nil {
+		server.Logger.Error("migration: unable to update config", "error", err)
+	}
+	return nil
+}
+
+// REDIX MIGRATE STATUS|COPY|CUTOVER timeout [FORCE]
+func (server *Server) migrate(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) < 3 {
+		return nil, wrongArgs("redix|migrate")
+	}
+	switch strings.ToLower(args[2].String()) {
+	case "status":
+		stats := server.MigrationStats()
+		lines := []string{
+			"migration_target:" + stats.Target,
+			"migration_copy:" + stats.Copy,
+			"migration_keys_scanned:" + strconv.FormatInt(stats.Scanned, 10),
+			"migration_keys_copied:" + strconv.FormatInt(stats.Copied, 10),
+			"migration_keys_failed:" + strconv.FormatInt(stats.Failed, 10),
+			"migration_keys_pending:" + strconv.FormatInt(stats.Pending, 10),
+			"",
+		}
+		return BulkString(strings.Join(lines, "\r\n")), nil
+	case "copy":
+		run := server.migration.current()
+		if run == nil {
+			return nil, errors.New("no migration in progress")
+		}
+		if !run.startCopy() {
+			return nil, errors.New("a copy is already running")
+		}
+		return SimpleString("OK"), nil
+	case "cutover":
+		if len(args) != 4 && len(args) != 5 {
+			return nil, wrongArgs("redix|migrate|cutover")
+		}
+		millis, err := strconv.Atoi(args[3].String())
+		if err != nil || millis < 0 {
+			return nil, errors.New("timeout is not an integer or out of range")
+		}
+		force := len(args) == 5
+		if force && !strings.EqualFold(args[4].String(), "force") {
+			return nil, errors.New("syntax error")
+		}
+		// Refused before the clients are disconnected
+		if run := server.migration.current(); run != nil && !force {
+			if err := run.checkCutover(); err != nil {
+				return nil, err
+			}
+		}
+		if err := server.Cutover(time.Duration(millis)*time.Millisecond, force); err != nil {
+			return Error("ERR " + err.Error()), ErrCloseClient
+		}
+		// The client's backend connection was closed
+		return SimpleString("OK"), ErrCloseClient
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try REDIX HELP.", args[2].String())
+	}
+}
+
+// Copies the keys written through the proxy to the migration target once
+// the write is done
+func (server *Server) migrateWrites(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	run := server.migration.current()
+	if !ok || run == nil {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	info, known := lookupCommand(cmd)
+	db, multi := proxy.session()
+	if name != "exec" && (!known || multi || !writes(info)) {
+		return next(ctx, cmd)
+	}
+
+	run.writes.RLock()
+	defer run.writes.RUnlock()
+	// Copied even if the write failed, as it may have been applied
+	reply, err := next(ctx, cmd)
+	if name == "exec" {
+		for _, queued := range proxy.txWrites {
+			info, _ := lookupCommand(queued)
+			run.write(db, info, queued)
+		}
+	} else {
+		run.write(db, info, cmd)
+	}
+	return reply, err
+}
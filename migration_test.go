@@ -0,0 +1,115 @@
+package redix_test
+
+import (
+	"strings"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migration", func() {
+	var (
+		backend, target *fakeRedis
+		server          *redix.Server
+		addr            string
+		stop            func()
+		client          *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		target = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Migration.Target = target.URL()
+		server = redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+		target.Close()
+	})
+
+	value := func(backend *fakeRedis, key string) func() string {
+		return func() string {
+			value, _ := backend.Value(key)
+			return value
+		}
+	}
+
+	It("Should copy the keys written through the proxy.", func() {
+		client.Do("SET", "foo", "1", "PX", "60000")
+		client.Do("SET", "bar", "2")
+		Eventually(value(target, "foo")).Should(Equal("1"))
+		Eventually(value(target, "bar")).Should(Equal("2"))
+		Expect(target.TTL("foo")).To(Equal("60000"))
+
+		// Reads are served by the old backend
+		Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+		Expect(backend.Gets()).To(Equal(1))
+		Expect(target.Gets()).To(Equal(0))
+
+		client.Do("DEL", "bar")
+		Eventually(func() bool {
+			_, ok := target.Value("bar")
+			return ok
+		}).Should(BeFalse())
+	})
+
+	It("Should copy the existing keys.", func() {
+		direct := dialProxy(strings.TrimPrefix(backend.URL(), "redis://"))
+		defer direct.Close()
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			direct.Do("SET", key, key)
+		}
+		direct.Do("SET", "f", "f", "PX", "5000")
+
+		Expect(client.Do("REDIX", "MIGRATE", "COPY")).To(Equal(redix.SimpleString("OK")))
+		Eventually(func() string {
+			return client.Do("REDIX", "MIGRATE", "STATUS").String()
+		}).Should(ContainSubstring("migration_copy:done\r\n"))
+		status := client.Do("REDIX", "MIGRATE", "STATUS").String()
+		Expect(status).To(ContainSubstring("migration_keys_scanned:6\r\n"))
+
+		Eventually(func() int64 { return server.MigrationStats().Copied }).Should(Equal(int64(6)))
+		Expect(value(target, "e")()).To(Equal("e"))
+		Expect(target.TTL("f")).To(Equal("5000"))
+	})
+
+	It("Should refuse to cut over before the existing keys are copied.", func() {
+		Expect(client.Do("REDIX", "MIGRATE", "CUTOVER", "1000")).
+			To(Equal(redix.Error("ERR the copy of the existing keys is idle, run REDIX MIGRATE COPY or use FORCE")))
+		Expect(client.Do("REDIX", "MIGRATE", "CUTOVER", "1000", "NOW")).To(Equal(redix.Error("ERR syntax error")))
+		Expect(server.MigrationStats().Target).NotTo(BeEmpty())
+
+		Expect(client.Do("REDIX", "MIGRATE", "CUTOVER", "1000", "FORCE")).To(Equal(redix.SimpleString("OK")))
+		Expect(server.Configs.Config().Backend).To(Equal(target.URL()))
+	})
+
+	It("Should switch to the target on cutover.", func() {
+		client.Do("SET", "foo", "1")
+		Expect(client.Do("REDIX", "MIGRATE", "COPY")).To(Equal(redix.SimpleString("OK")))
+		Eventually(func() string {
+			return client.Do("REDIX", "MIGRATE", "STATUS").String()
+		}).Should(ContainSubstring("migration_copy:done\r\n"))
+		Expect(client.Do("REDIX", "MIGRATE", "CUTOVER", "1000")).To(Equal(redix.SimpleString("OK")))
+		Expect(value(target, "foo")()).To(Equal("1"))
+
+		client.Close()
+		client = dialProxy(addr)
+		client.Do("SET", "bar", "2")
+		Expect(value(target, "bar")()).To(Equal("2"))
+		_, ok := backend.Value("bar")
+		Expect(ok).To(BeFalse())
+
+		Expect(server.Configs.Config().Backend).To(Equal(target.URL()))
+		Expect(server.MigrationStats().Target).To(BeEmpty())
+		Expect(client.Do("REDIX", "MIGRATE", "CUTOVER", "1000")).To(Equal(redix.Error("ERR no migration in progress")))
+	})
+})
@@ -0,0 +1,366 @@
+package redix
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// Wait before reconnecting to a mirror that failed
+	mirrorRetry = time.Second
+	// A mirror taking longer to reply is disconnected, so that it can't
+	// hold up the commands queued for it
+	mirrorReplyTimeout = 10 * time.Second
+)
+
+// A command copied to the mirror, with the primary's reply to it. Commands
+// the mirror connection sends itself have none.
+type mirrored struct {
+	db    string
+	cmd   Array
+	reply Resp
+}
+
+// MirrorStats counts the commands copied to the mirror
+type MirrorStats struct {
+	// Replied to by the mirror, with an error reply or not
+	Replied, Errors int64
+	// Lost to a connection failure
+	Failed int64
+	// Not sent because the mirror fell behind
+	Dropped int64
+	// Replies compared with the primary's, and those that differed
+	Compared, Mismatched int64
+}
+
+// mirror copies commands to a second backend in the background, discarding
+// its replies
+type mirror struct {
+	mu     sync.RWMutex
+	cfg    MirrorConfig
+	pool   *mirrorPool
+	logger *slog.Logger
+
+	replied, errors, failed, dropped int64
+	compared, mismatched             int64
+}
+
+func (mirror *mirror) configure(cfg MirrorConfig, timeouts TimeoutsConfig, logger *slog.Logger) {
+	mirror.mu.Lock()
+	defer mirror.mu.Unlock()
+
+	if reflect.DeepEqual(cfg, mirror.cfg) {
+		return
+	}
+	if mirror.pool != nil {
+		mirror.pool.close()
+		mirror.pool = nil
+	}
+	mirror.cfg, mirror.logger = cfg, logger
+	if cfg.Backend == "" {
+		return
+	}
+	ip, port, auth, _ := ParseRedisURL(cfg.Backend)
+	dialer := &Dialer{IP: ip, Port: port, Auth: auth, Timeout: time.Duration(timeouts.Connect), AuthTimeout: time.Duration(timeouts.Auth)}
+	mirror.pool = newMirrorPool(mirror, dialer, cfg)
+}
+
+func (mirror *mirror) close() {
+	mirror.configure(MirrorConfig{}, TimeoutsConfig{}, nil)
+}
+
+func (mirror *mirror) Stats() MirrorStats {
+	return MirrorStats{
+		Replied: atomic.LoadInt64(&mirror.replied),
+		Errors:  atomic.LoadInt64(&mirror.errors),
+		Failed:  atomic.LoadInt64(&mirror.failed),
+		Dropped: atomic.LoadInt64(&mirror.dropped),
+
+		Compared:   atomic.LoadInt64(&mirror.compared),
+		Mismatched: atomic.LoadInt64(&mirror.mismatched),
+	}
+}
+
+// Queues a command for the mirror, unless it is sampled out. Commands of a
+// client are sent in order.
+func (mirror *mirror) send(client int64, info CommandInfo, item mirrored) {
+	mirror.mu.RLock()
+	defer mirror.mu.RUnlock()
+
+	if mirror.pool == nil || mirror.cfg.ReadOnly && !info.ReadOnly() {
+		return
+	}
+	if rate := mirror.cfg.SampleRate; rate < 1 && rand.Float64() >= rate {
+		return
+	}
+	if !mirror.cfg.Compare || !deterministic(info) {
+		// Not compared
+		item.reply = nil
+	}
+	conn := mirror.pool.conns[int(client%int64(len(mirror.pool.conns)))]
+	select {
+	case conn.queue <- item:
+	default:
+		atomic.AddInt64(&mirror.dropped, 1)
+	}
+}
+
+type mirrorPool struct {
+	conns []*mirrorConn
+	stop  chan struct{}
+}
+
+func newMirrorPool(mirror *mirror, dialer *Dialer, cfg MirrorConfig) *mirrorPool {
+	pool := &mirrorPool{stop: make(chan struct{})}
+	n := cfg.Connections
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		conn := &mirrorConn{mirror: mirror, logger: mirror.logger, dialer: dialer, queue: make(chan mirrored, cfg.QueueSize/n+1)}
+		pool.conns = append(pool.conns, conn)
+		go conn.run(pool.stop)
+	}
+	return pool
+}
+
+func (pool *mirrorPool) close() {
+	close(pool.stop)
+}
+
+// A connection to the mirror. Commands are pipelined: they are written as
+// they are queued, and replies are read by another goroutine.
+type mirrorConn struct {
+	mirror *mirror
+	logger *slog.Logger
+	dialer *Dialer
+	queue  chan mirrored
+
+	conn    net.Conn
+	writer  *bufio.Writer
+	pending chan mirrored
+	db      string
+	// No dials are attempted before
+	retryAt time.Time
+}
+
+func (conn *mirrorConn) run(stop chan struct{}) {
+	defer conn.disconnect()
+	for {
+		select {
+		case item := <-conn.queue:
+			if !conn.write(item) {
+				atomic.AddInt64(&conn.mirror.failed, 1)
+			}
+			if len(conn.queue) == 0 && conn.writer != nil {
+				if err := conn.writer.Flush(); err != nil {
+					conn.disconnect()
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (conn *mirrorConn) write(item mirrored) bool {
+	if conn.conn == nil && !conn.connect() {
+		return false
+	}
+	if item.db != conn.db {
+		if _, err := conn.writer.Write(Array{BulkString("SELECT"), BulkString(item.db)}.Raw()); err != nil {
+			conn.disconnect()
+			return false
+		}
+		conn.pending <- mirrored{}
+		conn.db = item.db
+	}
+	if _, err := conn.writer.Write(item.cmd.Raw()); err != nil {
+		conn.disconnect()
+		return false
+	}
+	conn.pending <- item
+	return true
+}
+
+func (conn *mirrorConn) connect() bool {
+	if time.Now().Before(conn.retryAt) {
+		return false
+	}
+	netConn, err := conn.dialer.Dial()
+	if err != nil {
+		conn.retryAt = time.Now().Add(mirrorRetry)
+		return false
+	}
+	conn.conn, conn.writer, conn.db = netConn, bufio.NewWriter(netConn), "0"
+	// Writes block once the reader falls this far behind
+	conn.pending = make(chan mirrored, cap(conn.queue)+1)
+	go conn.read(netConn, conn.pending)
+	return true
+}
+
+func (conn *mirrorConn) disconnect() {
+	if conn.conn == nil {
+		return
+	}
+	conn.conn.Close()
+	close(conn.pending)
+	conn.conn, conn.writer, conn.pending = nil, nil, nil
+	conn.retryAt = time.Now().Add(mirrorRetry)
+}
+
+// Reads the replies to the pending commands until the connection fails
+func (conn *mirrorConn) read(netConn net.Conn, pending chan mirrored) {
+	reader := NewReader(netConn)
+	for item := range pending {
+		netConn.SetReadDeadline(time.Now().Add(mirrorReplyTimeout))
+		reply, err := reader.ParseObject()
+		if err != nil {
+			netConn.Close()
+			atomic.AddInt64(&conn.mirror.failed, 1)
+			// Drain the commands written after the failure
+			for range pending {
+				atomic.AddInt64(&conn.mirror.failed, 1)
+			}
+			return
+		}
+		if item.cmd == nil {
+			continue
+		}
+		if _, ok := reply.(Error); ok {
+			atomic.AddInt64(&conn.mirror.errors, 1)
+		} else {
+			atomic.AddInt64(&conn.mirror.replied, 1)
+		}
+		if item.reply != nil {
+			conn.compare(item, reply)
+		}
+	}
+}
+
+// Records the mirror's reply if it differs from the primary's
+func (conn *mirrorConn) compare(item mirrored, reply Resp) {
+	atomic.AddInt64(&conn.mirror.compared, 1)
+	name := strings.ToLower(item.cmd[0].String())
+	if bytes.Equal(normalizeReply(name, item.reply), normalizeReply(name, reply)) {
+		return
+	}
+	atomic.AddInt64(&conn.mirror.mismatched, 1)
+	conn.logger.Warn("mirror reply mismatch",
+		"command", item.cmd.HumanReadable(),
+		"db", item.db,
+		"primary", item.reply.HumanReadable(),
+		"mirror", reply.HumanReadable(),
+	)
+}
+
+// Read commands whose replies vary from one call to the next
+var nondeterministicCommands = map[string]bool{
+	"randomkey": true, "srandmember": true, "hrandfield": true, "zrandmember": true,
+	"scan": true, "sscan": true, "hscan": true, "zscan": true,
+	"ttl": true, "pttl": true, "time": true, "lastsave": true, "object": true,
+}
+
+// Read commands whose replies are sets, in an order that differs between
+// servers
+var unorderedReplies = map[string]bool{
+	"keys": true, "smembers": true, "sinter": true, "sunion": true, "sdiff": true,
+	"hkeys": true, "hvals": true,
+}
+
+// Whether the mirror's reply to the command should equal the primary's
+func deterministic(info CommandInfo) bool {
+	return info.ReadOnly() && !nondeterministicCommands[info.Name]
+}
+
+// Renders a reply so that equivalent replies are equal. Elements of sets
+// are sorted, and errors are reduced to their prefix, as their messages
+// vary between servers.
+func normalizeReply(name string, reply Resp) []byte {
+	switch reply := reply.(type) {
+	case Error:
+		return []byte("-" + errorPrefix(reply))
+	case Array:
+		if reply == nil {
+			break
+		}
+		var elems [][]byte
+		switch {
+		case unorderedReplies[name]:
+			for _, elem := range reply {
+				elems = append(elems, elem.Raw())
+			}
+		case name == "hgetall":
+			// Field and value pairs
+			for i := 0; i+1 < len(reply); i += 2 {
+				elems = append(elems, append(reply[i].Raw(), reply[i+1].Raw()...))
+			}
+		default:
+			return reply.Raw()
+		}
+		sort.Slice(elems, func(i, j int) bool { return bytes.Compare(elems[i], elems[j]) < 0 })
+		return bytes.Join(elems, nil)
+	}
+	return reply.Raw()
+}
+
+// Whether a command can be copied to a mirror. Commands that depend on the
+// connection's state, or would hold up the mirror connection, can't.
+func mirrorable(info CommandInfo) bool {
+	for _, category := range []string{"@connection", "@transaction", "@pubsub", "@admin", "@blocking"} {
+		if info.InCategory(category) {
+			return false
+		}
+	}
+	return true
+}
+
+// MirrorStats counts the commands copied to the mirror since it was started
+func (server *Server) MirrorStats() MirrorStats {
+	return server.mirror.Stats()
+}
+
+// Copies the commands forwarded to the backend to the mirror. The writes of
+// a transaction are copied once it executes.
+func (server *Server) mirrorCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	// Cleared by trackTransactions once EXEC returns
+	txWrites := proxy.txWrites
+	reply, err := next(ctx, cmd)
+	if err != nil {
+		return reply, err
+	}
+	if _, handled := server.commands[name]; handled {
+		return reply, err
+	}
+	info, known := lookupCommand(cmd)
+	db, multi := proxy.session()
+	if executed, ok := reply.(Array); name == "exec" && ok && executed != nil {
+		for _, queued := range txWrites {
+			// Not compared, as replies to the transaction's reads are
+			// interleaved with theirs
+			info, _ := lookupCommand(queued)
+			server.mirror.send(proxy.id, info, mirrored{db: db, cmd: queued})
+		}
+		return reply, err
+	}
+	if known && !multi && mirrorable(info) {
+		server.mirror.send(proxy.id, info, mirrored{db: db, cmd: cmd, reply: reply})
+	}
+	return reply, err
+}
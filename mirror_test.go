@@ -0,0 +1,123 @@
+package redix_test
+
+import (
+	"net"
+	"strings"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Mirroring", func() {
+	var (
+		backend, shadow *fakeRedis
+		server          *redix.Server
+		addr            string
+		stop            func()
+		client          *testClient
+		cfg             *redix.Config
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		shadow = newFakeRedis()
+		cfg = redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Mirror.Backend = shadow.URL()
+	})
+
+	JustBeforeEach(func() {
+		server = redix.NewServer(redix.StaticConfig(cfg))
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+		shadow.Close()
+	})
+
+	value := func(backend *fakeRedis, key string) func() string {
+		return func() string {
+			value, _ := backend.Value(key)
+			return value
+		}
+	}
+
+	It("Should copy commands to the mirror.", func() {
+		Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+		Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+		Eventually(value(shadow, "foo")).Should(Equal("1"))
+		Eventually(shadow.Gets).Should(Equal(1))
+		// Not a command the mirror can run out of context
+		client.Do("MULTI")
+		client.Do("SET", "bar", "1")
+		Consistently(value(shadow, "bar")).Should(BeEmpty())
+	})
+	It("Should copy the writes of a transaction once it executes.", func() {
+		client.Do("MULTI")
+		client.Do("SET", "foo", "1")
+		client.Do("DISCARD")
+		client.Do("MULTI")
+		client.Do("SET", "bar", "1")
+		client.Do("GET", "bar")
+		Consistently(value(shadow, "bar")).Should(BeEmpty())
+		Expect(client.Do("EXEC")).To(Equal(redix.Array{}))
+		Eventually(value(shadow, "bar")).Should(Equal("1"))
+		Expect(value(shadow, "foo")()).To(BeEmpty())
+		Expect(shadow.Gets()).To(Equal(0))
+	})
+
+	Context("When comparing replies", func() {
+		BeforeEach(func() {
+			cfg.Mirror.Compare = true
+		})
+
+		It("Should count mismatches.", func() {
+			client.Do("SET", "foo", "1")
+			client.Do("SET", "bar", "1")
+			Eventually(value(shadow, "bar")).Should(Equal("1"))
+			direct := dialProxy(strings.TrimPrefix(shadow.URL(), "redis://"))
+			defer direct.Close()
+			direct.Do("SET", "bar", "2")
+
+			client.Do("GET", "foo")
+			client.Do("GET", "bar")
+			Eventually(shadow.Gets).Should(Equal(2))
+			Eventually(func() int64 { return server.MirrorStats().Compared }).Should(Equal(int64(2)))
+			Expect(server.MirrorStats().Mismatched).To(Equal(int64(1)))
+		})
+	})
+
+	Context("With read-only mirroring", func() {
+		BeforeEach(func() {
+			cfg.Mirror.ReadOnly = true
+		})
+
+		It("Should only copy reads.", func() {
+			client.Do("SET", "foo", "1")
+			client.Do("GET", "foo")
+			Eventually(shadow.Gets).Should(Equal(1))
+			Expect(value(shadow, "foo")()).To(BeEmpty())
+		})
+	})
+
+	Context("When the mirror is down", func() {
+		BeforeEach(func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			cfg.Mirror.Backend = "redis://" + l.Addr().String()
+			l.Close()
+		})
+
+		It("Should still answer clients.", func() {
+			for i := 0; i < 10; i++ {
+				Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+				Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+			}
+		})
+	})
+})
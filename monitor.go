@@ -0,0 +1,130 @@
+package redix
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// monitors streams the commands of every client to the clients that ran
+// MONITOR or REDIX TAP
+type monitors struct {
+	// Checked by every command without taking the lock
+	count int32
+
+	mu   sync.RWMutex
+	subs map[*Proxy]*monitor
+}
+
+// A client streaming commands
+type monitor struct {
+	out *outputBuffer
+	// Glob-style patterns of the command names or keys streamed. Empty
+	// means all commands.
+	patterns []string
+}
+
+// Streams commands to the client from now on. Its replies go through the
+// same output buffer.
+func (monitors *monitors) add(proxy *Proxy, patterns []string) {
+	if proxy.monitor == nil {
+		proxy.monitor = newOutputBuffer(proxy.clientConn, proxy.outputLimits)
+	}
+	proxy.monitor.Write(SimpleString("OK").Raw())
+
+	monitors.mu.Lock()
+	defer monitors.mu.Unlock()
+	if monitors.subs == nil {
+		monitors.subs = map[*Proxy]*monitor{}
+	}
+	monitors.subs[proxy] = &monitor{out: proxy.monitor, patterns: patterns}
+	atomic.StoreInt32(&monitors.count, int32(len(monitors.subs)))
+}
+
+func (monitors *monitors) remove(proxy *Proxy) {
+	monitors.mu.Lock()
+	defer monitors.mu.Unlock()
+	if sub, ok := monitors.subs[proxy]; ok {
+		sub.out.Close()
+		delete(monitors.subs, proxy)
+		atomic.StoreInt32(&monitors.count, int32(len(monitors.subs)))
+	}
+}
+
+// Sends a command a client is about to run to the monitors it matches
+func (monitors *monitors) feed(proxy *Proxy, info CommandInfo, cmd Array) {
+	if atomic.LoadInt32(&monitors.count) == 0 {
+		return
+	}
+	db, _ := proxy.session()
+	line := SimpleString(monitorLine(time.Now(), db, proxy.ClientAddr(), redact(cmd))).Raw()
+	name := strings.ToLower(cmd[0].String())
+	keys, _ := info.Keys(cmd)
+
+	monitors.mu.RLock()
+	defer monitors.mu.RUnlock()
+	for client, sub := range monitors.subs {
+		if !sub.matches(name, keys) {
+			continue
+		}
+		if _, err := sub.out.Write(line); err == errOutputBufferLimit {
+			client.Logger.Warn("closing client over its output buffer limit")
+			client.Close()
+		}
+	}
+}
+
+func (sub *monitor) matches(name string, keys []string) bool {
+	if len(sub.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range sub.patterns {
+		if globMatch(strings.ToLower(pattern), name) {
+			return true
+		}
+		for _, key := range keys {
+			if globMatch(pattern, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Formats a command as Redis's MONITOR does, eg:
+// 1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func monitorLine(now time.Time, db, addr string, cmd Array) string {
+	return fmt.Sprintf("%d.%06d [%s %s] %s", now.Unix(), now.Nanosecond()/1000, db, addr, cmd.HumanReadable())
+}
+
+// Streams the commands clients send to monitors, before they run. As with
+// Redis, admin commands aren't shown.
+func (server *Server) feedMonitors(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || atomic.LoadInt32(&server.monitors.count) == 0 {
+		return next(ctx, cmd)
+	}
+	name := strings.ToLower(cmd[0].String())
+	info, known := lookupCommand(cmd)
+	_, handled := server.commands[name]
+	if !handled && !(known && (info.Admin() || info.HasFlag("skip_monitor"))) {
+		server.monitors.feed(proxy, info, cmd)
+	}
+	return next(ctx, cmd)
+}
+
+// MONITOR
+func (server *Server) monitorCommand(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) != 1 {
+		return nil, wrongArgs("monitor")
+	}
+	if denied := server.checkAdmin(proxy, "monitor"); denied != nil {
+		return denied, nil
+	}
+	server.monitors.add(proxy, nil)
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+package redix_test
+
+import (
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Monitor", func() {
+	var (
+		backend *fakeRedis
+		addr    string
+		stop    func()
+		client  *testClient
+		monitor *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		server := redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+		monitor = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		monitor.Close()
+		stop()
+		backend.Close()
+	})
+
+	next := func() string {
+		line, err := monitor.reader.ParseObject()
+		Expect(err).To(BeNil())
+		Expect(line).To(BeAssignableToTypeOf(redix.SimpleString("")))
+		return line.String()
+	}
+
+	It("Should stream the commands of every client.", func() {
+		Expect(monitor.Do("MONITOR")).To(Equal(redix.SimpleString("OK")))
+		addr := client.conn.LocalAddr().String()
+
+		client.Do("SET", "foo", "bar\r\n")
+		Expect(next()).To(MatchRegexp(`^\d+\.\d{6} \[0 ` + addr + `\] "SET" "foo" "bar\\r\\n"$`))
+		// Admin and proxy commands aren't shown
+		client.Do("DEBUG", "SLEEP", "0")
+		client.Do("REDIX", "INFO")
+		client.Do("AUTH", "secret")
+		Expect(next()).To(HaveSuffix(`] "AUTH" "(redacted)"`))
+		client.Do("SELECT", "1")
+		client.Do("GET", "foo")
+		Expect(next()).To(HaveSuffix(`"SELECT" "1"`))
+		Expect(next()).To(HaveSuffix(`[1 ` + addr + `] "GET" "foo"`))
+	})
+
+	It("Should only stream the commands a tap matches.", func() {
+		Expect(monitor.Do("REDIX", "TAP", "user:*", "PING")).To(Equal(redix.SimpleString("OK")))
+
+		client.Do("SET", "other", "1")
+		client.Do("SET", "user:1", "1")
+		Expect(next()).To(HaveSuffix(`"SET" "user:1" "1"`))
+		client.Do("GET", "other")
+		client.Do("PING")
+		Expect(next()).To(HaveSuffix(`"PING"`))
+
+		// The tapping client is still answered
+		Expect(monitor.Do("ECHO", "hi").String()).To(Equal("hi"))
+	})
+})
@@ -0,0 +1,257 @@
+package redix
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// CLIENT subcommands that only act on the client's own connection
+var connectionSubcommands = map[string]bool{
+	"id": true, "info": true, "getname": true, "setname": true, "setinfo": true, "reply": true,
+}
+
+// Reports whether a command can be confined to a namespace. Commands acting
+// on the whole keyspace can't, except those whose replies namespaceKeys
+// filters, nor scripts, which can reach any key, nor CLIENT subcommands
+// showing or acting on other connections.
+func namespaced(cmd Array) bool {
+	name := strings.ToLower(cmd[0].String())
+	switch name {
+	case "keys", "scan", "randomkey":
+		return true
+	case "client":
+		return len(cmd) > 1 && connectionSubcommands[strings.ToLower(cmd[1].String())]
+	}
+	info, ok := lookupCommand(cmd)
+	if !ok || info.InCategory("@dangerous") || info.InCategory("@scripting") || info.Admin() {
+		return false
+	}
+	if info.InCategory("@keyspace") && info.Step == 0 && !info.HasFlag("movablekeys") {
+		return false
+	}
+	return true
+}
+
+// Returns the namespace of clients connected to the listener at addr
+func (ns NamespacesConfig) forListener(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ns.Listeners[addr.String()]
+	}
+	for listen, prefix := range ns.Listeners {
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil || port != strconv.Itoa(tcpAddr.Port) {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.Equal(tcpAddr.IP)) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// Returns the namespace of a user, or the listener's if the user has none
+func (ns NamespacesConfig) forUser(user, listener string) string {
+	if prefix, ok := ns.Users[user]; ok {
+		return prefix
+	}
+	return listener
+}
+
+// Escapes the prefix for use in a glob-style pattern
+func globEscape(prefix string) string {
+	var escaped strings.Builder
+	for _, c := range prefix {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// Adds the client's namespace to the keys of commands, and strips it from
+// the keys in replies
+func (server *Server) namespaceKeys(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok || proxy.Namespace() == "" {
+		return next(ctx, cmd)
+	}
+	prefix := proxy.Namespace()
+	name := strings.ToLower(cmd[0].String())
+	if name == "redix" {
+		return next(ctx, cmd)
+	}
+	if !namespaced(cmd) {
+		return Error("ERR '" + name + "' command is not supported in a namespace"), nil
+	}
+	info, _ := lookupCommand(cmd)
+	positions, err := info.KeyPositions(cmd)
+	if err != nil {
+		return nil, err
+	}
+	prefixed := make(Array, len(cmd))
+	copy(prefixed, cmd)
+	for _, i := range positions {
+		prefixed[i] = BulkString(prefix + cmd[i].String())
+	}
+
+	switch name {
+	case "keys":
+		if len(cmd) != 2 {
+			return nil, wrongArgs("keys")
+		}
+		prefixed[1] = BulkString(globEscape(prefix) + cmd[1].String())
+	case "scan":
+		// Only the namespace is scanned
+		match := false
+		for i := 2; i+1 < len(prefixed); i += 2 {
+			if strings.EqualFold(prefixed[i].String(), "match") {
+				prefixed[i+1] = BulkString(globEscape(prefix) + prefixed[i+1].String())
+				match = true
+			}
+		}
+		if !match {
+			prefixed = append(prefixed, BulkString("MATCH"), BulkString(globEscape(prefix)+"*"))
+		}
+	case "randomkey":
+		return randomKeyIn(ctx, prefixed, prefix, next)
+	case "publish", "subscribe", "unsubscribe":
+		// Channels are confined to the namespace too
+		for i := 1; i < len(prefixed) && (name != "publish" || i == 1); i++ {
+			prefixed[i] = BulkString(prefix + cmd[i].String())
+		}
+	case "psubscribe", "punsubscribe":
+		for i := 1; i < len(prefixed); i++ {
+			prefixed[i] = BulkString(globEscape(prefix) + cmd[i].String())
+		}
+	case "pubsub":
+		if len(cmd) < 2 {
+			return nil, wrongArgs("pubsub")
+		}
+		switch strings.ToLower(cmd[1].String()) {
+		case "channels":
+			pattern := "*"
+			if len(cmd) > 2 {
+				pattern = cmd[2].String()
+			}
+			prefixed = append(prefixed[:2], BulkString(globEscape(prefix)+pattern))
+		case "numsub":
+			for i := 2; i < len(prefixed); i++ {
+				prefixed[i] = BulkString(prefix + cmd[i].String())
+			}
+		default:
+			return Error("ERR 'pubsub|" + strings.ToLower(cmd[1].String()) + "' command is not supported in a namespace"), nil
+		}
+		name = "pubsub " + strings.ToLower(cmd[1].String())
+	}
+
+	reply, err := next(ctx, prefixed)
+	if err != nil {
+		return reply, err
+	}
+	return unprefixReply(name, reply, prefix), nil
+}
+
+// Strips the namespace from the keys in a reply
+func unprefixReply(name string, reply Resp, prefix string) Resp {
+	array, ok := reply.(Array)
+	if !ok || array == nil {
+		return reply
+	}
+	unprefix := func(key Resp) Resp {
+		return BulkString(strings.TrimPrefix(key.String(), prefix))
+	}
+	switch name {
+	case "keys":
+		keys := make(Array, len(array))
+		for i, key := range array {
+			keys[i] = unprefix(key)
+		}
+		return keys
+	case "scan":
+		if len(array) == 2 {
+			return Array{array[0], unprefixReply("keys", array[1], prefix)}
+		}
+	case "blpop", "brpop", "bzpopmin", "bzpopmax", "lmpop", "blmpop", "zmpop", "bzmpop":
+		// The key comes first
+		if len(array) > 0 {
+			unprefixed := make(Array, len(array))
+			copy(unprefixed, array)
+			unprefixed[0] = unprefix(array[0])
+			return unprefixed
+		}
+	case "unsubscribe", "punsubscribe":
+		// Outside of passthrough, when there were no subscriptions
+		return unprefixMessage(reply, prefix)
+	case "pubsub channels":
+		return unprefixReply("keys", array, prefix)
+	case "pubsub numsub":
+		// Channel and count pairs
+		counts := make(Array, len(array))
+		copy(counts, array)
+		for i := 0; i < len(counts); i += 2 {
+			counts[i] = unprefix(array[i])
+		}
+		return counts
+	case "xread", "xreadgroup":
+		// An array of [key, entries]
+		streams := make(Array, len(array))
+		for i, stream := range array {
+			streams[i] = unprefixReply("blpop", stream, prefix)
+		}
+		return streams
+	}
+	return reply
+}
+
+// RANDOMKEY can't be restricted to a namespace, so it is retried a few
+// times until it lands in it
+func randomKeyIn(ctx context.Context, cmd Array, prefix string, next Handler) (Resp, error) {
+	for i := 0; i < 16; i++ {
+		reply, err := next(ctx, cmd)
+		if err != nil {
+			return reply, err
+		}
+		key, ok := reply.(BulkString)
+		if !ok || key == nil {
+			return reply, nil
+		}
+		if strings.HasPrefix(key.String(), prefix) {
+			return BulkString(strings.TrimPrefix(key.String(), prefix)), nil
+		}
+	}
+	return BulkString(nil), nil
+}
+
+// Strips the namespace from the channels and patterns of the replies to
+// subscribers
+func unprefixMessage(reply Resp, prefix string) Resp {
+	array, ok := reply.(Array)
+	if !ok || len(array) < 2 {
+		return reply
+	}
+	unprefixed := make(Array, len(array))
+	copy(unprefixed, array)
+	trim := func(i int, prefix string) {
+		if channel, ok := array[i].(BulkString); ok && channel != nil {
+			unprefixed[i] = BulkString(strings.TrimPrefix(channel.String(), prefix))
+		}
+	}
+	switch strings.ToLower(array[0].String()) {
+	case "message", "subscribe", "unsubscribe":
+		trim(1, prefix)
+	case "psubscribe", "punsubscribe":
+		trim(1, globEscape(prefix))
+	case "pmessage":
+		if len(array) == 4 {
+			trim(1, globEscape(prefix))
+			trim(2, prefix)
+		}
+	}
+	return unprefixed
+}
@@ -0,0 +1,142 @@
+package redix_test
+
+import (
+	"net"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Namespaces", func() {
+	var (
+		backend *fakeRedis
+		tenant  net.Listener
+		shared  net.Listener
+		client  *testClient
+		stop    func()
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		var err error
+		tenant, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		shared, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Auth.Password = "secret"
+		cfg.Auth.Users = map[string]string{"bob": "b"}
+		cfg.Commands.Rewrite = map[string]string{"keys": "scan"}
+		cfg.Namespaces = redix.NamespacesConfig{
+			Listeners: map[string]string{tenant.Addr().String(): "a:"},
+			Users:     map[string]string{"bob": "b:"},
+		}
+		server := redix.NewServer(redix.StaticConfig(cfg))
+		_, stop = startProxy(server, tenant, shared)
+
+		client = dialProxy(tenant.Addr().String())
+		Expect(client.Do("AUTH", "secret").String()).To(Equal("OK"))
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	It("Should confine channels to the namespace.", func() {
+		subscriber := dialProxy(tenant.Addr().String())
+		defer subscriber.Close()
+		Expect(subscriber.Do("AUTH", "secret").String()).To(Equal("OK"))
+		Expect(subscriber.Do("SUBSCRIBE", "news")).To(Equal(redix.Array{redix.BulkString("subscribe"), redix.BulkString("news"), redix.Integer("1")}))
+		psubscriber := dialProxy(tenant.Addr().String())
+		defer psubscriber.Close()
+		Expect(psubscriber.Do("AUTH", "secret").String()).To(Equal("OK"))
+		Expect(psubscriber.Do("PSUBSCRIBE", "n*")).To(Equal(redix.Array{redix.BulkString("psubscribe"), redix.BulkString("n*"), redix.Integer("1")}))
+
+		other := dialProxy(shared.Addr().String())
+		defer other.Close()
+		Expect(other.Do("AUTH", "bob", "b").String()).To(Equal("OK"))
+		// Another namespace's channel of the same name
+		Expect(other.Do("PUBLISH", "news", "theirs").String()).To(Equal("0"))
+		Expect(other.Do("PUBSUB", "CHANNELS", "*")).To(Equal(redix.Array{}))
+
+		Expect(client.Do("PUBSUB", "CHANNELS")).To(Equal(redix.Array{redix.BulkString("news")}))
+		Expect(client.Do("PUBLISH", "news", "ours").String()).To(Equal("2"))
+		message, err := subscriber.reader.ParseObject()
+		Expect(err).To(BeNil())
+		Expect(message).To(Equal(redix.Array{redix.BulkString("message"), redix.BulkString("news"), redix.BulkString("ours")}))
+		message, err = psubscriber.reader.ParseObject()
+		Expect(err).To(BeNil())
+		Expect(message).To(Equal(redix.Array{redix.BulkString("pmessage"), redix.BulkString("n*"), redix.BulkString("news"), redix.BulkString("ours")}))
+	})
+	It("Should prefix keys by listener.", func() {
+		Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+		Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+		Expect(client.Do("UNLINK", "foo", "bar").String()).To(Equal("1"))
+		Expect(client.Do("SET", "foo", "2").String()).To(Equal("OK"))
+
+		other := dialProxy(shared.Addr().String())
+		defer other.Close()
+		Expect(other.Do("AUTH", "secret").String()).To(Equal("OK"))
+		Expect(other.Do("GET", "foo")).To(Equal(redix.BulkString(nil)))
+		Expect(other.Do("GET", "a:foo").String()).To(Equal("2"))
+	})
+	It("Should prefer the user's namespace.", func() {
+		Expect(client.Do("AUTH", "bob", "b").String()).To(Equal("OK"))
+		Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+		Expect(client.Do("AUTH", "secret").String()).To(Equal("OK"))
+		Expect(client.Do("GET", "foo")).To(Equal(redix.BulkString(nil)))
+
+		other := dialProxy(shared.Addr().String())
+		defer other.Close()
+		Expect(other.Do("AUTH", "bob", "b").String()).To(Equal("OK"))
+		Expect(other.Do("GET", "foo").String()).To(Equal("1"))
+	})
+	It("Should only list keys in the namespace.", func() {
+		for _, key := range []string{"x:1", "x:2", "y:1"} {
+			client.Do("SET", key, "1")
+		}
+		other := dialProxy(shared.Addr().String())
+		defer other.Close()
+		Expect(other.Do("AUTH", "secret").String()).To(Equal("OK"))
+		other.Do("SET", "x:3", "1")
+
+		Expect(client.Do("KEYS", "x:*").String()).To(Equal("[x:1 x:2]"))
+		Expect(client.Do("SCAN", "0").String()).To(Equal("[2 [x:1 x:2]]"))
+		Expect(other.Do("KEYS", "x:*").String()).To(Equal("[x:3]"))
+	})
+	It("Should reject commands that would escape the namespace.", func() {
+		client.Do("SET", "foo", "1")
+		Expect(client.Do("FLUSHALL")).To(Equal(redix.Error("ERR 'flushall' command is not supported in a namespace")))
+		Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+	})
+	It("Should keep tenants from seeing other clients' commands and keys.", func() {
+		// Without auth, clients outside namespaces are admins
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Namespaces.Listeners = map[string]string{l.Addr().String(): "a:"}
+		addr, stop := startProxy(redix.NewServer(redix.StaticConfig(cfg)), l)
+		defer stop()
+
+		tenant := dialProxy(addr)
+		defer tenant.Close()
+		for _, args := range [][]string{{"MONITOR"}, {"REDIX", "TAP", "*"}, {"REDIX", "HOTKEYS"}, {"REDIX", "SLOWLOG", "GET"}, {"REDIX", "CONFIG", "SET", "log.level", "debug"}} {
+			Expect(tenant.Do(args...)).To(BeAssignableToTypeOf(redix.Error{}))
+		}
+		Expect(tenant.Do("REDIX", "SLOWLOG", "LEN")).To(BeAssignableToTypeOf(redix.Integer("")))
+	})
+	It("Should reject scripts and other clients' connections.", func() {
+		Expect(client.Do("EVAL", "return redis.call('GET', 'b:' .. 'foo')", "0")).To(Equal(redix.Error("ERR 'eval' command is not supported in a namespace")))
+		Expect(client.Do("FCALL", "steal", "0")).To(Equal(redix.Error("ERR 'fcall' command is not supported in a namespace")))
+		Expect(client.Do("SCRIPT", "LOAD", "return 1")).To(Equal(redix.Error("ERR 'script' command is not supported in a namespace")))
+		Expect(client.Do("CLIENT", "LIST")).To(Equal(redix.Error("ERR 'client' command is not supported in a namespace")))
+		Expect(client.Do("CLIENT", "KILL", "ID", "2")).To(Equal(redix.Error("ERR 'client' command is not supported in a namespace")))
+		Expect(client.Do("CLIENT", "ID").String()).To(Equal("1"))
+	})
+})
@@ -4,10 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
 )
 
 type Proxy struct {
@@ -16,16 +22,64 @@ type Proxy struct {
 	clientConn   net.Conn
 	serverConn   net.Conn
 	clientReader *RESPReader
-	Verbose      bool
+	serverReader *RESPReader
+	Logger       *slog.Logger
+	Tracer       trace.Tracer
+
+	// Set once the connection switches to streaming replies
+	passthrough bool
+	// Set once the client runs MONITOR or REDIX TAP. Replies are written
+	// through it, along with the commands streamed.
+	monitor *outputBuffer
+	// The writes queued in a transaction, to be accounted for once it
+	// executes. See trackTransactions.
+	txWrites []Array
+	// Whether the command being handled passed the interceptors that may
+	// reject it. See countCommands.
+	passed bool
+
+	// See TimeoutsConfig.Command and LimitsConfig.OutputBuffer
+	commandTimeout time.Duration
+	outputLimits   OutputBufferConfig
+	// Namespace of the listener the client connected to
+	listenerNamespace string
+
+	created   time.Time
+	closeOnce sync.Once
+	// The context of the command being handled
+	ctx context.Context
+
+	// Guards the client info below, which is read by other connections
+	mu         sync.Mutex
+	id         int64
+	lastCmd    string
+	lastActive time.Time
+	db         string
+	user       string
+	// The ACL user of the backend connection, as set by a forwarded AUTH
+	backendUser string
+	namespace   string
+	busy        bool
+	stopped     bool
+	// In a MULTI transaction
+	multi bool
 }
 
-func NewProxy(clientConn net.Conn, dialer *Dialer, mgr *ConnectionManager) Proxy {
-	return Proxy{
+func NewProxy(clientConn net.Conn, dialer *Dialer, mgr *ConnectionManager) *Proxy {
+	now := time.Now()
+	return &Proxy{
 		dialer:       dialer,
 		mgr:          mgr,
 		clientConn:   clientConn,
 		clientReader: NewReader(clientConn),
-		Verbose:      true,
+		Logger:       slog.Default(),
+		Tracer:       noopTracer,
+		ctx:          context.Background(),
+		created:      now,
+		lastActive:   now,
+		db:           "0",
+		user:         DefaultUser,
+		backendUser:  DefaultUser,
 	}
 }
 
@@ -33,6 +87,150 @@ func (proxy *Proxy) String() string {
 	return fmt.Sprintf("%s <> %s", proxy.clientName(), proxy.serverName())
 }
 
+// ClientAddr returns the remote address of the client
+func (proxy *Proxy) ClientAddr() string {
+	return proxy.clientName()
+}
+
+// ClientInfo describes the client in the style of CLIENT LIST
+func (proxy *Proxy) ClientInfo() string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s backend=%s age=%d idle=%d db=%s user=%s cmd=%s",
+		proxy.id,
+		proxy.clientName(),
+		proxy.serverName(),
+		int(now.Sub(proxy.created).Seconds()),
+		int(now.Sub(proxy.lastActive).Seconds()),
+		proxy.db,
+		proxy.user,
+		proxy.lastCmd,
+	)
+}
+
+// User returns the user the client authenticated as
+func (proxy *Proxy) User() string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.user
+}
+
+func (proxy *Proxy) setUser(user string) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.user = user
+}
+
+// Namespace returns the prefix added to the keys of the client's commands
+func (proxy *Proxy) Namespace() string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.namespace
+}
+
+func (proxy *Proxy) setNamespace(namespace string) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.namespace = namespace
+}
+
+// A proxy is busy from the moment a command is read until its reply is written
+func (proxy *Proxy) setBusy(busy bool) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.busy = busy
+}
+
+// Stops reading commands from the client. An idle client's read is
+// interrupted rather than its connection closed, so that a command read
+// before it is marked busy still gets its reply.
+func (proxy *Proxy) stopReading() {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.stopped = true
+	if !proxy.busy {
+		proxy.clientConn.SetReadDeadline(time.Now())
+	}
+}
+
+// Sets the deadline for reading the next command, unless the proxy has
+// stopped reading
+func (proxy *Proxy) setReadDeadline(deadline time.Time) bool {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if proxy.stopped {
+		return false
+	}
+	proxy.clientConn.SetReadDeadline(deadline)
+	return true
+}
+
+// BackendUser returns the ACL user the backend connection is authenticated
+// as, which differs from User when clients AUTH with the backend itself
+func (proxy *Proxy) BackendUser() string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.backendUser
+}
+
+// Records the user of a forwarded AUTH or HELLO ... AUTH the backend
+// accepted. Those queued in a transaction only apply once it is executed,
+// so they are ignored.
+func (proxy *Proxy) trackBackendUser(cmd Array, reply Resp) {
+	if _, failed := reply.(Error); failed {
+		return
+	}
+	user := ""
+	switch strings.ToLower(cmd[0].String()) {
+	case "auth":
+		// AUTH [username] password
+		user = DefaultUser
+		if len(cmd) == 3 {
+			user = cmd[1].String()
+		}
+	case "hello":
+		// HELLO protover AUTH username password
+		for i := 2; i+2 < len(cmd); i++ {
+			if strings.EqualFold(cmd[i].String(), "auth") {
+				user = cmd[i+1].String()
+			}
+		}
+	}
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if user != "" && !proxy.multi {
+		proxy.backendUser = user
+	}
+}
+
+// Records the command for ClientInfo
+func (proxy *Proxy) track(args Array) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	proxy.lastCmd = strings.ToLower(args[0].String())
+	proxy.lastActive = time.Now()
+	switch proxy.lastCmd {
+	case "select":
+		if len(args) == 2 {
+			proxy.db = args[1].String()
+		}
+	case "multi":
+		proxy.multi = true
+	case "exec", "discard":
+		proxy.multi = false
+	}
+}
+
+// Returns the selected db, and whether a transaction is open
+func (proxy *Proxy) session() (string, bool) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.db, proxy.multi
+}
+
 func (proxy *Proxy) clientName() string {
 	if proxy.clientConn == nil {
 		return "<disconnected>"
@@ -47,21 +245,94 @@ func (proxy *Proxy) serverName() string {
 	return proxy.serverConn.RemoteAddr().String()
 }
 
+// Context returns the context of the command being handled, which carries
+// its trace span. It is cancelled once the client is disconnected.
+func (proxy *Proxy) Context() context.Context {
+	return proxy.ctx
+}
+
+// Backend returns the address of the backend new connections are made to
+func (proxy *Proxy) Backend() string {
+	return proxy.dialer.Addr()
+}
+
 func (proxy *Proxy) Open() error {
 	// Try to open a connection to the server
-	serverConn, err := proxy.dialer.Dial()
+	serverConn, err := proxy.dialer.DialContext(proxy.ctx)
 	if err != nil {
 		proxy.WriteClientErr(err)
 		return err
 	}
 
 	proxy.serverConn = proxy.mgr.Add(serverConn) // Manage server connections only
-	// Will return when serverConn is closed
-	go io.Copy(proxy.clientConn, proxy.serverConn)
-	proxy.Println("proxy opened")
+	proxy.serverReader = NewReader(proxy.serverConn)
+	if conn, ok := proxy.serverConn.(*Conn); ok {
+		proxy.Logger = proxy.Logger.With("conn_id", conn.ID())
+	}
+	proxy.Logger.Debug("proxy opened", "backend", proxy.serverName())
+	return nil
+}
+
+// Forward sends cmd to the backend and returns its reply. The reply may be
+// an Error, which is a valid reply rather than a failure to forward.
+func (proxy *Proxy) Forward(cmd Array) (Resp, error) {
+	if proxy.passthrough {
+		// Replies are streamed straight to the client
+		return nil, proxy.WriteServerObject(cmd.Raw())
+	}
+	if proxy.commandTimeout > 0 && len(cmd) > 0 && !blocking(strings.ToLower(cmd[0].String())) {
+		proxy.serverConn.SetDeadline(time.Now().Add(proxy.commandTimeout))
+		defer proxy.serverConn.SetDeadline(time.Time{})
+	}
+	if err := proxy.WriteServerObject(cmd.Raw()); err != nil {
+		return nil, err
+	}
+	reply, err := proxy.serverReader.ParseObject()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil, errBackendTimeout
+	}
+	return reply, err
+}
+
+// Passthrough forwards cmd and from then on streams every backend reply to
+// the client as it arrives. This is needed by commands like SUBSCRIBE,
+// whose replies don't pair up with requests. Forward only writes
+// once the connection is in passthrough, and it remains so until closed.
+func (proxy *Proxy) Passthrough(cmd Array) error {
+	if err := proxy.WriteServerObject(cmd.Raw()); err != nil {
+		return err
+	}
+	if !proxy.passthrough {
+		proxy.passthrough = true
+		// Will return when serverConn is closed
+		go proxy.stream()
+	}
 	return nil
 }
 
+// Copies backend replies to the client through an output buffer, closing
+// the client if it falls too far behind. In a namespace, it is stripped
+// from the channels of the replies.
+func (proxy *Proxy) stream() {
+	out := newOutputBuffer(proxy.clientConn, proxy.outputLimits)
+	defer out.Close()
+	var err error
+	if prefix := proxy.Namespace(); prefix == "" {
+		_, err = io.Copy(out, proxy.serverReader)
+	} else {
+		for err == nil {
+			var reply Resp
+			if reply, err = proxy.serverReader.ParseObject(); err == nil {
+				_, err = out.Write(unprefixMessage(reply, prefix).Raw())
+			}
+		}
+	}
+	if err == errOutputBufferLimit {
+		proxy.Logger.Warn("closing client over its output buffer limit")
+		proxy.Close()
+	}
+}
+
 func (proxy *Proxy) ReadClientObject() ([]byte, error) {
 	body, err := proxy.clientReader.ReadObject()
 	if err != nil {
@@ -83,14 +354,19 @@ func (proxy *Proxy) ParseClientObject() (Array, error) {
 }
 
 func (proxy *Proxy) WriteClientErr(e error) error {
-	_, err := proxy.clientConn.Write([]byte("-ERR " + e.Error() + "\r\n"))
+	return proxy.WriteClientObject([]byte("-ERR " + e.Error() + "\r\n"))
+}
+
+func (proxy *Proxy) WriteClientObject(body []byte) error {
+	if proxy.monitor != nil {
+		_, err := proxy.monitor.Write(body)
+		return err
+	}
+	_, err := proxy.clientConn.Write(body)
 	return err
 }
 
 func (proxy *Proxy) WriteServerObject(body []byte) error {
-	if proxy.Verbose {
-		fmt.Printf("%v -> %v %q\n", proxy.clientName(), proxy.serverName(), body) // proxy.SprintRESP(body))
-	}
 	_, err := proxy.serverConn.Write(body)
 	if err != nil {
 		return err
@@ -98,25 +374,17 @@ func (proxy *Proxy) WriteServerObject(body []byte) error {
 	return nil
 }
 
-func (proxy *Proxy) Println(msg ...interface{}) {
-	if proxy.Verbose {
-		args := make([]interface{}, len(msg)+1)
-		args[0] = proxy
-		for i := 1; i < len(args); i++ {
-			args[i] = msg[i-1]
-		}
-		fmt.Println(args...)
-	}
-}
-
+// Close is safe to call more than once and from other goroutines
 func (proxy *Proxy) Close() {
-	if proxy.serverConn != nil {
-		proxy.serverConn.Close()
-	}
-	if proxy.clientConn != nil {
-		proxy.clientConn.Close()
-	}
-	proxy.Println("proxy closed")
+	proxy.closeOnce.Do(func() {
+		if proxy.serverConn != nil {
+			proxy.serverConn.Close()
+		}
+		if proxy.clientConn != nil {
+			proxy.clientConn.Close()
+		}
+		proxy.Logger.Debug("proxy closed")
+	})
 }
 
 // 1. Lock dialer
@@ -124,15 +392,31 @@ func (proxy *Proxy) Close() {
 // 3. execute promotion
 // 4. Reset dialer with promoted vals
 // 5. Unlock dialer
-func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
+func (proxy *Proxy) Promote(slaveID, auth, timeout string) (err error) {
 	proxy.dialer.mu.Lock()
 	defer proxy.dialer.mu.Unlock()
 
-	proxy.Println("promote:", "id="+slaveID, "timeout="+timeout)
+	// Each phase of the promotion gets a span of its own
+	ctx, span := proxy.Tracer.Start(proxy.Context(), "promote", trace.WithAttributes(attribute.String("redix.slave", slaveID)))
+	var phase trace.Span
+	startPhase := func(name string) {
+		if phase != nil {
+			phase.End()
+		}
+		_, phase = proxy.Tracer.Start(ctx, name)
+	}
+	defer func() {
+		if phase != nil {
+			endSpan(phase, err)
+		}
+		endSpan(span, err)
+	}()
+
+	proxy.Logger.Info("promote", "slave", slaveID, "timeout", timeout)
 
 	// Create a new connection to the master
-	dialer := Dialer{IP: proxy.dialer.IP, Port: proxy.dialer.Port, Auth: proxy.dialer.Auth}
-	masterConn, err := dialer.Dial()
+	dialer := Dialer{IP: proxy.dialer.IP, Port: proxy.dialer.Port, Auth: proxy.dialer.Auth, Timeout: proxy.dialer.Timeout, AuthTimeout: proxy.dialer.AuthTimeout}
+	masterConn, err := dialer.DialContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -145,6 +429,7 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 	}
 	cancel := time.After(time.Duration(millis) * time.Millisecond)
 
+	startPhase("promote.pause")
 	proxy.mgr.CloseAll()
 
 	multiExec := [][]byte{
@@ -154,35 +439,39 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 		[]byte("*1\r\n$4\r\nEXEC\r\n"),
 	}
 
-	proxy.Println("promote:", "pausing clients for", timeout, "milliseconds")
+	proxy.Logger.Info("promote: pausing clients", "millis", timeout)
 	var info string
 	for _, cmd := range multiExec {
-		proxy.Println("promote:", fmt.Sprintf("-> %q", cmd))
+		proxy.Logger.Debug("promote: sending", "cmd", string(cmd))
 		if _, err := masterConn.Write(cmd); err != nil {
-			proxy.Println("promote:", "ERR", err)
+			proxy.Logger.Error("promote: failed", "error", err)
 			return err
 		}
 		resp, err := masterReader.ParseObject()
 		if err != nil {
-			proxy.Println("promote:", "ERR", err)
+			proxy.Logger.Error("promote: failed", "error", err)
 			return errors.New("unable to pause clients")
 		}
 		switch t := resp.(type) {
 		case Error:
-			proxy.Println("promote:", fmt.Sprintf("<- %q", t.String()))
+			proxy.Logger.Error("promote: failed", "error", t.String())
 			return errors.New(t.String())
 		// EXEC returns an array, where the first item is a Bulk String INFO result
 		case Array:
 			for _, r := range t {
 				if e, ok := r.(Error); ok {
-					proxy.Println("promote:", fmt.Sprintf("<- %q", e.String()))
+					proxy.Logger.Error("promote: failed", "error", e.String())
 					return errors.New(e.String())
 				}
-				proxy.Println("promote:", fmt.Sprintf("<- %q", r.String()))
+				proxy.Logger.Debug("promote: received", "reply", r.String())
+			}
+			if len(t) == 0 {
+				proxy.Logger.Error("promote: failed", "error", "empty EXEC reply")
+				return errors.New("unable to read replication info")
 			}
 			info = t[0].String() // Just the info
 		default:
-			proxy.Println("promote:", fmt.Sprintf("<- %q", t.String()))
+			proxy.Logger.Debug("promote: received", "reply", t.String())
 		}
 	}
 
@@ -210,11 +499,12 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 		return errors.New("no 'master_repl_offset' value")
 	}
 
-	proxy.Println("promote:", "master_repl_offset:"+masterReplOffset)
+	proxy.Logger.Info("promote: waiting for slave to sync", "master_repl_offset", masterReplOffset)
 
 	// Create a new connection to the slave
-	dialer = Dialer{IP: ip, Port: port, Auth: auth}
-	slaveConn, err := dialer.Dial()
+	startPhase("promote.sync")
+	dialer = Dialer{IP: ip, Port: port, Auth: auth, Timeout: proxy.dialer.Timeout, AuthTimeout: proxy.dialer.AuthTimeout}
+	slaveConn, err := dialer.DialContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -232,7 +522,7 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 		}
 		resp, err := slaveReader.ParseObject()
 		if err != nil {
-			proxy.Println("promote:", "ERR:", err)
+			proxy.Logger.Error("promote: failed", "error", err)
 			return errors.New("unable to discover slave replication offset")
 		}
 		info, ok := resp.(BulkString)
@@ -248,7 +538,7 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 		if !ok {
 			return fmt.Errorf("no slave '%s' replicating", slaveID)
 		}
-		proxy.Println("promote:", "slave_repl_offset:"+slaveReplOffset)
+		proxy.Logger.Debug("promote: slave offset", "slave_repl_offset", slaveReplOffset)
 		if len(masterReplOffset) <= len(slaveReplOffset) || masterReplOffset < slaveReplOffset {
 			break
 		}
@@ -260,6 +550,7 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 	default:
 	}
 
+	startPhase("promote.slaveof")
 	if _, err := slaveConn.Write([]byte("*3\r\n$7\r\nSLAVEOF\r\n$2\r\nNO\r\n$3\r\nONE\r\n")); err != nil {
 		return err
 	}
@@ -271,8 +562,9 @@ func (proxy *Proxy) Promote(slaveID, auth, timeout string) error {
 		return errors.New(string(e))
 	}
 
-	proxy.clientConn.Write([]byte("+OK\r\n"))
+	startPhase("promote.reset")
 	proxy.dialer.Reset(ip, port, auth)
+	span.SetAttributes(attribute.String("redix.backend", net.JoinHostPort(ip, port)))
 
 	return nil
 }
@@ -0,0 +1,198 @@
+package redix
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Buckets are swept when their number doubles, dropping those that have
+// refilled and so hold no state worth keeping
+const minBucketsSwept = 1024
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimit struct {
+	RateLimitConfig
+	// Nil if the limit applies to every command
+	commands   map[string]bool
+	categories []string
+	perSec     float64
+	burst      float64
+
+	buckets map[string]*tokenBucket
+	sweepAt int
+}
+
+// Takes a token from the bucket, returning how long to wait for it. The
+// token is only taken if the wait is no longer than maxWait.
+func (limit *rateLimit) take(key string, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	bucket, ok := limit.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.burst, last: now}
+		limit.buckets[key] = bucket
+		limit.sweep(now)
+	}
+	bucket.tokens = math.Min(limit.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.perSec)
+	bucket.last = now
+
+	var wait time.Duration
+	if bucket.tokens < 1 {
+		wait = time.Duration((1 - bucket.tokens) / limit.perSec * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	bucket.tokens--
+	return wait, true
+}
+
+// Gives back a token taken for a command that was then rejected
+func (limit *rateLimit) refund(key string) {
+	if bucket, ok := limit.buckets[key]; ok {
+		bucket.tokens = math.Min(limit.burst, bucket.tokens+1)
+	}
+}
+
+// Whether the limit applies to the command, by name or category
+func (limit *rateLimit) applies(name string, info CommandInfo) bool {
+	if limit.commands == nil || limit.commands[name] {
+		return true
+	}
+	for _, category := range limit.categories {
+		if info.InCategory(category) {
+			return true
+		}
+	}
+	return false
+}
+
+func (limit *rateLimit) sweep(now time.Time) {
+	if len(limit.buckets) < limit.sweepAt {
+		return
+	}
+	for key, bucket := range limit.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limit.perSec >= limit.burst {
+			delete(limit.buckets, key)
+		}
+	}
+	limit.sweepAt = 2 * len(limit.buckets)
+	if limit.sweepAt < minBucketsSwept {
+		limit.sweepAt = minBucketsSwept
+	}
+}
+
+// rateLimiter enforces the rate_limits of the config
+type rateLimiter struct {
+	mu      sync.Mutex
+	configs []RateLimitConfig
+	limits  []*rateLimit
+}
+
+// Replaces the limits, unless they are unchanged, so that reloads don't
+// refill every bucket
+func (limiter *rateLimiter) configure(configs []RateLimitConfig) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if reflect.DeepEqual(configs, limiter.configs) {
+		return
+	}
+	limiter.configs = configs
+	limiter.limits = nil
+	for _, cfg := range configs {
+		limit := &rateLimit{
+			RateLimitConfig: cfg,
+			perSec:          cfg.Rate / time.Duration(cfg.Interval).Seconds(),
+			burst:           float64(cfg.Burst),
+			buckets:         map[string]*tokenBucket{},
+			sweepAt:         minBucketsSwept,
+		}
+		if limit.burst == 0 {
+			limit.burst = math.Max(1, math.Ceil(cfg.Rate))
+		}
+		if len(cfg.Commands) > 0 {
+			limit.commands = map[string]bool{}
+			for _, name := range cfg.Commands {
+				if strings.HasPrefix(name, "@") {
+					limit.categories = append(limit.categories, strings.ToLower(name))
+				} else {
+					limit.commands[strings.ToLower(name)] = true
+				}
+			}
+		}
+		limiter.limits = append(limiter.limits, limit)
+	}
+}
+
+// Takes a token from every limit applying to the command. Returns how long
+// the command must be delayed, or the limit rejecting it, in which case no
+// token is taken.
+func (limiter *rateLimiter) take(name, ip, user string) (time.Duration, *rateLimit) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	info, _ := LookupCommand(name)
+	now := time.Now()
+	var delay time.Duration
+	var taken []*rateLimit
+	var keys []string
+	for _, limit := range limiter.limits {
+		if !limit.applies(name, info) {
+			continue
+		}
+		var key string
+		switch limit.Per {
+		case "ip":
+			key = ip
+		case "user":
+			key = user
+		}
+		var maxWait time.Duration
+		if limit.Action == "delay" {
+			maxWait = time.Duration(limit.MaxDelay)
+		}
+		wait, ok := limit.take(key, now, maxWait)
+		if !ok {
+			for i, limit := range taken {
+				limit.refund(keys[i])
+			}
+			return 0, limit
+		}
+		taken, keys = append(taken, limit), append(keys, key)
+		if wait > delay {
+			delay = wait
+		}
+	}
+	return delay, nil
+}
+
+// Rejects or delays commands over the rate limits
+func (server *Server) rateLimit(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	ip, _, _ := net.SplitHostPort(proxy.ClientAddr())
+	delay, limit := server.limiter.take(strings.ToLower(cmd[0].String()), ip, proxy.User())
+	if limit != nil {
+		return Error(fmt.Sprintf("RATELIMITED %s rate limit exceeded", limit.Name)), nil
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return next(ctx, cmd)
+}
@@ -0,0 +1,155 @@
+package redix_test
+
+import (
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limits", func() {
+	var (
+		backend *fakeRedis
+		cfg     *redix.Config
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg = redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Auth.Users = map[string]string{"alice": "a", "bob": "b"}
+	})
+
+	JustBeforeEach(func() {
+		server := redix.NewServer(redix.StaticConfig(cfg))
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	Context("Rejecting", func() {
+		BeforeEach(func() {
+			cfg.RateLimits = []redix.RateLimitConfig{{
+				Name:     "reads",
+				Commands: []string{"GET"},
+				Per:      "user",
+				Rate:     2,
+				Interval: redix.Duration(time.Minute),
+				Action:   "reject",
+			}}
+		})
+
+		It("Should reject commands over the limit.", func() {
+			Expect(client.Do("AUTH", "alice", "a").String()).To(Equal("OK"))
+			Expect(client.Do("GET", "foo")).To(Equal(redix.BulkString(nil)))
+			Expect(client.Do("GET", "foo")).To(Equal(redix.BulkString(nil)))
+			Expect(client.Do("GET", "foo")).To(Equal(redix.Error("RATELIMITED reads rate limit exceeded")))
+			// Other commands aren't limited
+			Expect(client.Do("PING").String()).To(Equal("PONG"))
+		})
+		It("Should give each user a bucket.", func() {
+			Expect(client.Do("AUTH", "alice", "a").String()).To(Equal("OK"))
+			client.Do("GET", "foo")
+			client.Do("GET", "foo")
+			Expect(client.Do("GET", "foo")).To(BeAssignableToTypeOf(redix.Error{}))
+
+			other := dialProxy(addr)
+			defer other.Close()
+			Expect(other.Do("AUTH", "bob", "b").String()).To(Equal("OK"))
+			Expect(other.Do("GET", "foo")).To(Equal(redix.BulkString(nil)))
+		})
+	})
+
+	Context("By category", func() {
+		BeforeEach(func() {
+			cfg.Auth.Users = nil
+			cfg.RateLimits = []redix.RateLimitConfig{{
+				Name:     "all",
+				Per:      "global",
+				Rate:     3,
+				Interval: redix.Duration(time.Minute),
+				Action:   "reject",
+			}, {
+				Name:     "writes",
+				Commands: []string{"@write"},
+				Per:      "global",
+				Rate:     1,
+				Interval: redix.Duration(time.Minute),
+				Action:   "reject",
+			}}
+		})
+
+		It("Should limit the commands of a category.", func() {
+			Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+			Expect(client.Do("DEL", "foo")).To(Equal(redix.Error("RATELIMITED writes rate limit exceeded")))
+		})
+		It("Should not use up other limits when rejecting.", func() {
+			Expect(client.Do("SET", "foo", "1").String()).To(Equal("OK"))
+			Expect(client.Do("SET", "foo", "2")).To(BeAssignableToTypeOf(redix.Error{}))
+			Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+			Expect(client.Do("GET", "foo").String()).To(Equal("1"))
+			Expect(client.Do("GET", "foo")).To(Equal(redix.Error("RATELIMITED all rate limit exceeded")))
+		})
+	})
+
+	Context("Delaying", func() {
+		BeforeEach(func() {
+			cfg.Auth.Users = nil
+			cfg.RateLimits = []redix.RateLimitConfig{{
+				Name:     "all",
+				Per:      "ip",
+				Rate:     10,
+				Interval: redix.Duration(time.Second),
+				Burst:    1,
+				Action:   "delay",
+				MaxDelay: redix.Duration(150 * time.Millisecond),
+			}}
+		})
+
+		It("Should delay commands over the limit.", func() {
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				Expect(client.Do("PING").String()).To(Equal("PONG"))
+			}
+			Expect(time.Since(start)).To(BeNumerically(">=", 150*time.Millisecond))
+		})
+		It("Should reject commands that would wait too long.", func() {
+			// Clients from the same ip share a bucket
+			clients := []*testClient{client}
+			for i := 0; i < 3; i++ {
+				other := dialProxy(addr)
+				defer other.Close()
+				clients = append(clients, other)
+			}
+			for _, c := range clients {
+				_, err := c.conn.Write(redix.Array{redix.BulkString("PING")}.Raw())
+				Expect(err).To(BeNil())
+			}
+			var replies []redix.Resp
+			for _, c := range clients {
+				reply, err := c.reader.ParseObject()
+				Expect(err).To(BeNil())
+				replies = append(replies, reply)
+			}
+			Expect(replies).To(ContainElement(redix.Error("RATELIMITED all rate limit exceeded")))
+		})
+	})
+
+	Context("With users", func() {
+		It("Should authenticate users.", func() {
+			Expect(client.Do("PING")).To(Equal(redix.Error("NOAUTH Authentication required.")))
+			Expect(client.Do("AUTH", "alice", "b")).To(Equal(redix.Error("ERR invalid password")))
+			Expect(client.Do("AUTH", "alice", "a").String()).To(Equal("OK"))
+			Expect(client.Do("REDIX", "CLIENTS").String()).To(ContainSubstring("user=alice"))
+		})
+	})
+})
@@ -4,10 +4,14 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"os"
 	"testing"
 )
 
 func TestRedix(t *testing.T) {
+	if os.Getenv("REDIX_UPGRADE_FDS") != "" {
+		serveUpgraded()
+	}
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Redix Suite")
 }
@@ -72,8 +72,18 @@ func (resp Array) String() string {
 func (resp Integer) Raw() []byte      { return raw(':', []byte(resp)) }
 func (resp SimpleString) Raw() []byte { return raw('+', []byte(resp)) }
 func (resp Error) Raw() []byte        { return raw('-', []byte(resp)) }
-func (resp BulkString) Raw() []byte   { return raw('$', []byte(fmt.Sprint(len(resp))), []byte(resp)) }
+func (resp BulkString) Raw() []byte {
+	// Null Bulk String
+	if resp == nil {
+		return []byte("$-1\r\n")
+	}
+	return raw('$', []byte(fmt.Sprint(len(resp))), []byte(resp))
+}
 func (resp Array) Raw() []byte {
+	// Null Array
+	if resp == nil {
+		return []byte("*-1\r\n")
+	}
 	r := []byte(fmt.Sprintf("*%d\r\n", len(resp)))
 	for _, elem := range resp {
 		r = append(r, elem.Raw()...)
@@ -198,6 +208,8 @@ func (r *RESPReader) readArray(line []byte) ([]byte, error) {
 	return line, nil
 }
 
+// The line is only valid until the next read, so the value is copied out
+// of it, as parseSimpleString does
 func (r *RESPReader) parseInteger(line []byte) (Integer, error) {
 	n := line[1 : len(line)-2]
 	for _, b := range n {
@@ -205,7 +217,7 @@ func (r *RESPReader) parseInteger(line []byte) (Integer, error) {
 			return nil, ErrInvalidSyntax
 		}
 	}
-	return Integer(n), nil
+	return Integer(append([]byte(nil), n...)), nil
 }
 
 func (r *RESPReader) parseError(line []byte) (Error, error) {
@@ -223,7 +235,7 @@ func (r *RESPReader) parseSimpleString(line []byte) (SimpleString, error) {
 			return nil, ErrInvalidSyntax
 		}
 	}
-	return SimpleString(ss), nil
+	return SimpleString(append([]byte(nil), ss...)), nil
 }
 
 // In readBulkString() we parse the length specification for the bulk string to know how many
@@ -0,0 +1,31 @@
+package redix_test
+
+import (
+	"bytes"
+	"testing/iotest"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RESPReader", func() {
+	It("Should keep parsed values intact across reads.", func() {
+		// Read a byte at a time, so that the buffer is refilled between values
+		reader := redix.NewReader(iotest.OneByteReader(bytes.NewReader([]byte(":5\r\n+OK\r\n-ERR no\r\n+PONG\r\n:12345\r\n-WRONGTYPE x\r\n"))))
+		var values []redix.Resp
+		for i := 0; i < 6; i++ {
+			value, err := reader.ParseObject()
+			Expect(err).To(BeNil())
+			values = append(values, value)
+		}
+		Expect(values).To(Equal([]redix.Resp{
+			redix.Integer("5"),
+			redix.SimpleString("OK"),
+			redix.Error("ERR no"),
+			redix.SimpleString("PONG"),
+			redix.Integer("12345"),
+			redix.Error("WRONGTYPE x"),
+		}))
+	})
+})
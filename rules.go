@@ -0,0 +1,177 @@
+package redix
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// KEYS is rewritten into SCANs of this many keys
+const keysScanCount = "1000"
+
+type denyRule struct {
+	name, sub string
+	// nil means all users
+	users map[string]bool
+}
+
+// commandRules enforces the commands section of the config
+type commandRules struct {
+	mu      sync.RWMutex
+	deny    []denyRule
+	renamed map[string]string // from the original name to the new one
+	aliases map[string]string // from the new name to the original one
+	rewrite map[string]string
+}
+
+func (rules *commandRules) configure(cfg CommandsConfig) {
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+
+	rules.deny = nil
+	for _, deny := range cfg.Deny {
+		var users map[string]bool
+		if len(deny.Users) > 0 {
+			users = map[string]bool{}
+			for _, user := range deny.Users {
+				users[user] = true
+			}
+		}
+		for _, command := range deny.Commands {
+			fields := strings.Fields(strings.ToLower(command))
+			if len(fields) == 0 {
+				continue
+			}
+			rule := denyRule{name: fields[0], users: users}
+			if len(fields) > 1 {
+				rule.sub = fields[1]
+			}
+			rules.deny = append(rules.deny, rule)
+		}
+	}
+
+	rules.renamed, rules.aliases = map[string]string{}, map[string]string{}
+	for name, to := range cfg.Rename {
+		name, to = strings.ToLower(name), strings.ToLower(to)
+		rules.renamed[name] = to
+		if to != "" {
+			rules.aliases[to] = name
+		}
+	}
+	rules.rewrite = map[string]string{}
+	for name, to := range cfg.Rewrite {
+		rules.rewrite[strings.ToLower(name)] = strings.ToLower(to)
+	}
+}
+
+// Translates a renamed command back to its original name. Returns false if
+// the command was renamed away, in which case it is unknown.
+func (rules *commandRules) resolve(cmd Array) (Array, bool) {
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+
+	name := strings.ToLower(cmd[0].String())
+	if original, ok := rules.aliases[name]; ok {
+		resolved := make(Array, len(cmd))
+		copy(resolved, cmd)
+		resolved[0] = BulkString(original)
+		return resolved, true
+	}
+	if _, ok := rules.renamed[name]; ok {
+		return cmd, false
+	}
+	return cmd, true
+}
+
+func (rules *commandRules) denied(cmd Array, user string) bool {
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+
+	name := strings.ToLower(cmd[0].String())
+	for _, rule := range rules.deny {
+		if rule.name != name || (rule.users != nil && !rule.users[user]) {
+			continue
+		}
+		if rule.sub == "" || (len(cmd) > 1 && strings.EqualFold(cmd[1].String(), rule.sub)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rules *commandRules) rewritten(name string) string {
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+	return rules.rewrite[name]
+}
+
+// Denies and rewrites commands according to the config
+func (server *Server) enforceRules(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	user := DefaultUser
+	if proxy, ok := ProxyFromContext(ctx); ok {
+		user = proxy.User()
+	}
+	name := strings.ToLower(cmd[0].String())
+	if server.rules.denied(cmd, user) {
+		return Error(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", user, name)), nil
+	}
+
+	to := server.rules.rewritten(name)
+	switch {
+	case to == "":
+		return next(ctx, cmd)
+	case name == "keys":
+		// Inside MULTI, the SCAN would only be queued, so KEYS is sent as is
+		if proxy, ok := ProxyFromContext(ctx); ok {
+			if _, multi := proxy.session(); multi {
+				return next(ctx, cmd)
+			}
+		}
+		return keysByScan(ctx, cmd, next)
+	default:
+		rewritten := make(Array, len(cmd))
+		copy(rewritten, cmd)
+		rewritten[0] = BulkString(to)
+		return next(ctx, rewritten)
+	}
+}
+
+// Answers KEYS pattern by iterating over the keyspace with SCAN, so that the
+// backend isn't blocked for the whole iteration
+func keysByScan(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	if len(cmd) != 2 {
+		return nil, wrongArgs("keys")
+	}
+	keys := Array{}
+	seen := map[string]bool{}
+	cursor := "0"
+	for {
+		reply, err := next(ctx, Array{
+			BulkString("SCAN"), BulkString(cursor),
+			BulkString("MATCH"), cmd[1],
+			BulkString("COUNT"), BulkString(keysScanCount),
+		})
+		if err != nil {
+			return reply, err
+		}
+		page, ok := reply.(Array)
+		if !ok || len(page) != 2 {
+			// Most likely an error reply
+			return reply, nil
+		}
+		batch, _ := page[1].(Array)
+		for _, key := range batch {
+			// SCAN may return a key more than once
+			if !seen[key.String()] {
+				seen[key.String()] = true
+				keys = append(keys, key)
+			}
+		}
+		cursor = page[0].String()
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package redix_test
+
+import (
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Command rules", func() {
+	var (
+		backend *fakeRedis
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Auth.Users = map[string]string{"alice": "a", "admin": "b"}
+		cfg.Commands = redix.CommandsConfig{
+			Deny: []redix.DenyConfig{
+				{Commands: []string{"flushall", "redix config"}, Users: []string{"alice"}},
+			},
+			Rename:  map[string]string{"echo": "say", "ping": ""},
+			Rewrite: map[string]string{"del": "unlink", "keys": "scan"},
+		}
+		server := redix.NewServer(redix.StaticConfig(cfg))
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+		Expect(client.Do("AUTH", "alice", "a").String()).To(Equal("OK"))
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	It("Should deny commands to some users.", func() {
+		Expect(client.Do("FLUSHALL")).To(Equal(redix.Error("NOPERM User alice has no permissions to run the 'flushall' command")))
+		Expect(client.Do("REDIX", "CONFIG", "GET", "*")).To(BeAssignableToTypeOf(redix.Error{}))
+		Expect(client.Do("REDIX", "INFO")).To(BeAssignableToTypeOf(redix.BulkString{}))
+
+		Expect(client.Do("AUTH", "admin", "b").String()).To(Equal("OK"))
+		Expect(client.Do("FLUSHALL").String()).To(Equal("OK"))
+	})
+	It("Should rename commands.", func() {
+		Expect(client.Do("SAY", "hi").String()).To(Equal("hi"))
+		Expect(client.Do("ECHO", "hi")).To(Equal(redix.Error("ERR unknown command 'ECHO'")))
+		Expect(client.Do("PING")).To(Equal(redix.Error("ERR unknown command 'PING'")))
+	})
+	It("Should rewrite commands.", func() {
+		client.Do("SET", "foo", "1")
+		client.Do("SET", "bar", "1")
+		// The backend knows neither DEL nor KEYS
+		Expect(client.Do("DEL", "foo", "baz").String()).To(Equal("1"))
+		for _, key := range []string{"a:1", "a:2", "a:3", "b:1"} {
+			client.Do("SET", key, "1")
+		}
+		Expect(client.Do("KEYS", "a:*").String()).To(Equal("[a:1 a:2 a:3]"))
+	})
+	It("Should send KEYS as is inside transactions.", func() {
+		Expect(client.Do("MULTI").String()).To(Equal("OK"))
+		Expect(client.Do("KEYS", "a:*")).To(Equal(redix.Error("ERR unknown command 'KEYS'")))
+		Expect(client.Do("EXEC").String()).To(Equal("[]"))
+		Expect(client.Do("KEYS", "a:*").String()).To(Equal("[]"))
+	})
+})
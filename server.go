@@ -0,0 +1,556 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// Version is reported by REDIX INFO
+const Version = "0.2.0"
+
+// CommandHandler handles a command in place of the backend. cmd includes the
+// command name. A handler may reply locally, reject the command with an
+// error, or pass it on to the backend with proxy.Forward, optionally after
+// rewriting it. The returned reply is written to the client, and a returned
+// error is written as an -ERR reply. Return an Error reply to reject with a
+// prefix other than ERR.
+type CommandHandler interface {
+	ServeCommand(proxy *Proxy, cmd Array) (Resp, error)
+}
+
+// CommandHandlerFunc adapts a function to a CommandHandler
+type CommandHandlerFunc func(proxy *Proxy, cmd Array) (Resp, error)
+
+func (fn CommandHandlerFunc) ServeCommand(proxy *Proxy, cmd Array) (Resp, error) {
+	return fn(proxy, cmd)
+}
+
+// ErrCloseClient may be returned by a CommandHandler to close the client's
+// connection once the reply, if any, is written.
+var ErrCloseClient = errors.New("close client")
+
+// Server accepts client connections and proxies them to the backend
+// described by its Dialer, intercepting the proxy's own commands.
+type Server struct {
+	Dialer  *Dialer
+	Conns   *ConnectionManager
+	Configs *ConfigWatcher
+	Metrics *Metrics
+	Logger  *slog.Logger
+	Slowlog *Slowlog
+	// Defaults to a no-op tracer. See NewTracerProvider.
+	Tracer trace.Tracer
+	// OnUpgrade, if set, is called with the new process once Upgrade
+	// succeeds. It is expected to Shutdown the server.
+	OnUpgrade func(child *os.Process)
+
+	logLevel *slog.LevelVar
+
+	started   time.Time
+	commands  map[string]CommandHandler
+	routes    []route
+	limiter   rateLimiter
+	rules     commandRules
+	cache     *nearCache
+	coalescer coalescer
+	mirror    mirror
+	migration migration
+	capture   capture
+	monitors  monitors
+	keyStats  keyStats
+	cmdStats  commandStats
+
+	// Tracks handle goroutines for Shutdown
+	wg sync.WaitGroup
+
+	mu       sync.RWMutex
+	clientID int64
+	clients  map[int64]*Proxy
+	// Clients accepted, including those not yet connected to the backend
+	reserved  int
+	listeners map[net.Listener]struct{}
+	draining  bool
+	upgraded  bool
+	// The backend the command table was refreshed from
+	commandsFrom string
+}
+
+func NewServer(configs *ConfigWatcher) *Server {
+	cfg := configs.Config()
+	ip, port, auth, _ := ParseRedisURL(cfg.Backend)
+	logLevel := &slog.LevelVar{}
+
+	server := &Server{
+		Logger:    NewLogger(os.Stdout, cfg.Log, logLevel),
+		logLevel:  logLevel,
+		Slowlog:   NewSlowlog(cfg.Slowlog.MaxLen),
+		Tracer:    noopTracer,
+		Dialer:    &Dialer{IP: ip, Port: port, Auth: auth, Breaker: NewBreaker(0, 0)},
+		Conns:     NewConnectionManager(),
+		Configs:   configs,
+		started:   time.Now(),
+		commands:  map[string]CommandHandler{},
+		clients:   map[int64]*Proxy{},
+		listeners: map[net.Listener]struct{}{},
+		cache:     newNearCache(),
+	}
+	server.configureDialer(cfg)
+	server.HandleFunc("promote", server.promote)
+	server.HandleFunc("redix", server.redix)
+	server.HandleFunc("monitor", server.monitorCommand)
+	server.Metrics = newMetrics(server)
+	server.limiter.configure(cfg.RateLimits)
+	server.rules.configure(cfg.Commands)
+	server.cache.configure(cfg.Cache, server.Dialer, server.Logger)
+	server.coalescer.configure(cfg.Coalesce)
+	server.mirror.configure(cfg.Mirror, cfg.Timeouts, server.Logger)
+	server.migration.configure(cfg.Migration, cfg.Backend, cfg.Timeouts, server.Logger)
+	server.keyStats.configure(cfg.KeyStats)
+	server.Use(server.traceCommands, server.logCommands, server.feedMonitors, server.countCommands, server.Metrics.Interceptor, server.enforceRules, server.rateLimit, server.namespaceKeys, server.passCommands, server.captureCommands, server.countKeys, server.mirrorCommands, server.trackTransactions, server.migrateWrites, server.cacheReads, server.coalesceReads)
+	return server
+}
+
+// Handle registers the handler for a command name, case insensitively. It
+// replaces any previous handler, including those built in, so it may also
+// be used to intercept regular Redis commands. Handle must not be called
+// once the server is serving.
+func (server *Server) Handle(name string, handler CommandHandler) {
+	server.commands[strings.ToLower(name)] = handler
+}
+
+func (server *Server) HandleFunc(name string, fn func(proxy *Proxy, cmd Array) (Resp, error)) {
+	server.Handle(name, CommandHandlerFunc(fn))
+}
+
+// Reload applies a reloaded config. New connections pick up the new
+// backend while existing ones stay up.
+func (server *Server) Reload(old, cfg *Config) {
+	if level, err := parseLevel(cfg.Log.Level); err == nil {
+		server.logLevel.Set(level)
+	}
+
+	server.Slowlog.Resize(cfg.Slowlog.MaxLen)
+	server.limiter.configure(cfg.RateLimits)
+	server.rules.configure(cfg.Commands)
+	server.cache.configure(cfg.Cache, server.Dialer, server.Logger)
+	server.coalescer.configure(cfg.Coalesce)
+	server.mirror.configure(cfg.Mirror, cfg.Timeouts, server.Logger)
+	server.migration.configure(cfg.Migration, cfg.Backend, cfg.Timeouts, server.Logger)
+	server.keyStats.configure(cfg.KeyStats)
+
+	server.Dialer.mu.Lock()
+	defer server.Dialer.mu.Unlock()
+
+	if cfg.Backend != old.Backend {
+		ip, port, auth, _ := ParseRedisURL(cfg.Backend)
+		server.Dialer.Reset(ip, port, auth)
+	}
+	server.configureDialer(cfg)
+}
+
+// Call with the dialer locked
+func (server *Server) configureDialer(cfg *Config) {
+	dialer := server.Dialer
+	dialer.Timeout = time.Duration(cfg.Timeouts.Connect)
+	dialer.AuthTimeout = time.Duration(cfg.Timeouts.Auth)
+	dialer.Attempts = cfg.Retry.Attempts
+	dialer.Backoff = time.Duration(cfg.Retry.Backoff)
+	dialer.MaxBackoff = time.Duration(cfg.Retry.MaxBackoff)
+	if dialer.Breaker != nil {
+		dialer.Breaker.Configure(cfg.Breaker.Threshold, time.Duration(cfg.Breaker.Cooldown))
+	}
+}
+
+// ErrServerClosed is returned by Serve once Shutdown has been called
+var ErrServerClosed = errors.New("redix: Server closed")
+
+// Serve accepts connections on l until it is closed or Shutdown is called.
+// Cancelling ctx closes l and every connection accepted from it without
+// waiting for in-flight commands.
+func (server *Server) Serve(ctx context.Context, l net.Listener) error {
+	if !server.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer server.trackListener(l, false)
+	stop := afterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	for {
+		// Listen for an incoming connection.
+		clientConn, err := l.Accept()
+		if err != nil {
+			if server.isDraining() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		cfg := server.Configs.Config()
+		if !server.reserveClient(cfg.Limits.MaxClients) {
+			clientConn.Write([]byte("-ERR max number of clients reached\r\n"))
+			clientConn.Close()
+			continue
+		}
+
+		if tcpConn, ok := clientConn.(*net.TCPConn); ok {
+			keepAlive := time.Duration(cfg.Timeouts.KeepAlive)
+			tcpConn.SetKeepAlive(keepAlive > 0)
+			if keepAlive > 0 {
+				tcpConn.SetKeepAlivePeriod(keepAlive)
+			}
+		}
+
+		clientConn = countingConn{Conn: clientConn, in: server.Metrics.BytesIn, out: server.Metrics.BytesOut}
+		proxy := NewProxy(clientConn, server.Dialer, server.Conns)
+		proxy.Logger = server.Logger.With("client_addr", proxy.ClientAddr())
+		proxy.Tracer = server.Tracer
+		proxy.commandTimeout = time.Duration(cfg.Timeouts.Command)
+		proxy.outputLimits = cfg.Limits.OutputBuffer
+		proxy.listenerNamespace = cfg.Namespaces.forListener(l.Addr())
+		proxy.namespace = cfg.Namespaces.forUser(DefaultUser, proxy.listenerNamespace)
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			defer server.releaseClient()
+			server.handle(ctx, proxy, cfg)
+		}()
+	}
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections,
+// closes idle clients and lets in-flight commands finish and their replies
+// be written before closing the remaining clients. If ctx expires first,
+// every client is closed at once and ctx's error is returned without waiting
+// for their handlers to return. Finally, all backend connections are closed.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.draining = true
+	for l := range server.listeners {
+		l.Close()
+	}
+	server.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+
+	// Busy clients close themselves after their reply is written
+	for _, proxy := range server.Clients() {
+		proxy.stopReading()
+	}
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Closing interrupts their backend I/O, but handlers aren't waited on
+		for _, proxy := range server.Clients() {
+			proxy.Close()
+		}
+	}
+	server.cache.close()
+	server.mirror.close()
+	server.migration.close()
+	server.capture.end()
+	server.Conns.CloseAll()
+	return err
+}
+
+func (server *Server) isDraining() bool {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.draining
+}
+
+// Returns false if the listener can't be added because the server is shut down
+func (server *Server) trackListener(l net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if add {
+		if server.draining {
+			return false
+		}
+		server.listeners[l] = struct{}{}
+	} else {
+		delete(server.listeners, l)
+	}
+	return true
+}
+
+func (server *Server) NumClients() int {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return len(server.clients)
+}
+
+// Clients returns the connected clients ordered by id
+func (server *Server) Clients() []*Proxy {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+
+	clients := make([]*Proxy, 0, len(server.clients))
+	for _, proxy := range server.clients {
+		clients = append(clients, proxy)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// Reserves a slot for a client as soon as it is accepted, so that clients
+// still connecting to the backend count towards max, if any
+func (server *Server) reserveClient(max int) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if max > 0 && server.reserved >= max {
+		return false
+	}
+	server.reserved++
+	return true
+}
+
+func (server *Server) releaseClient() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.reserved--
+}
+
+func (server *Server) addClient(proxy *Proxy) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.clientID++
+	proxy.id = server.clientID
+	proxy.Logger = proxy.Logger.With("client_id", proxy.id)
+	server.clients[proxy.id] = proxy
+}
+
+func (server *Server) removeClient(proxy *Proxy) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	delete(server.clients, proxy.id)
+}
+
+func (server *Server) handle(ctx context.Context, proxy *Proxy, cfg *Config) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	proxy.ctx = ctx
+	// Cancelling the context interrupts the proxy's blocking reads and writes
+	stop := afterFunc(ctx, proxy.Close)
+	defer stop()
+
+	// Make sure to close both client and proxy connections on defer
+	defer proxy.Close()
+
+	if err := proxy.Open(); err != nil {
+		return
+	}
+	server.refreshCommands(cfg)
+
+	server.addClient(proxy)
+	defer server.removeClient(proxy)
+	defer server.monitors.remove(proxy)
+	// Shutdown may have missed this client
+	if server.isDraining() {
+		return
+	}
+
+	authed := !cfg.Auth.Required()
+	idle := time.Duration(cfg.Timeouts.Idle)
+	for {
+		// Subscribers and monitors may wait indefinitely for messages
+		var deadline time.Time
+		if idle > 0 && !proxy.passthrough && proxy.monitor == nil {
+			deadline = time.Now().Add(idle)
+		}
+		if !proxy.setReadDeadline(deadline) {
+			return
+		}
+		array, err := proxy.ParseClientObject()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if !server.isDraining() {
+				proxy.Logger.Debug("closing idle client", "idle", idle)
+			}
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !server.isDraining() {
+				proxy.Logger.Debug("client read failed", "error", err)
+				proxy.WriteClientErr(err)
+			}
+			return
+		}
+		if len(array) == 0 {
+			continue
+		}
+
+		proxy.setBusy(true)
+		closeClient := server.handleCommand(ctx, proxy, array, cfg, &authed)
+		proxy.setBusy(false)
+		if closeClient || server.isDraining() {
+			return
+		}
+	}
+}
+
+// Handles a single command and writes its reply. Returns true if the
+// client's connection should be closed.
+func (server *Server) handleCommand(ctx context.Context, proxy *Proxy, array Array, cfg *Config, authed *bool) bool {
+	start := time.Now()
+	proxy.track(array)
+
+	name := strings.ToLower(array[0].String())
+	if name == "auth" && cfg.Auth.Required() {
+		// AUTH [username] password
+		user, ok := cfg.Auth.Check(array[1:])
+		if !ok {
+			proxy.WriteClientErr(errors.New("invalid password"))
+			return false
+		}
+		*authed = true
+		proxy.setUser(user)
+		proxy.setNamespace(cfg.Namespaces.forUser(user, proxy.listenerNamespace))
+		proxy.WriteClientObject(SimpleString("OK").Raw())
+		return false
+	}
+	if !*authed {
+		proxy.WriteClientObject(Error("NOAUTH Authentication required.").Raw())
+		return false
+	}
+
+	if name == "hello" && len(array) > 1 && array[1].String() != "2" {
+		// The reply parser only understands RESP2
+		proxy.WriteClientObject(Error("NOPROTO unsupported protocol version").Raw())
+		return false
+	}
+
+	array, known := server.rules.resolve(array)
+	if !known {
+		proxy.WriteClientObject(Error(fmt.Sprintf("ERR unknown command '%s'", array[0].String())).Raw())
+		return false
+	}
+	name = strings.ToLower(array[0].String())
+
+	handler := server.chain(name, func(ctx context.Context, cmd Array) (Resp, error) {
+		proxy.ctx = ctx
+		return server.serveCommand(proxy, cmd)
+	})
+	reply, err := handler(withProxy(ctx, proxy), array)
+	if reply != nil {
+		if werr := proxy.WriteClientObject(reply.Raw()); werr != nil {
+			return true
+		}
+	}
+	if err != nil && err != ErrCloseClient {
+		proxy.WriteClientErr(err)
+	}
+	if threshold := time.Duration(server.Configs.Config().Slowlog.Threshold); threshold >= 0 {
+		if duration := time.Since(start); duration >= threshold {
+			server.Slowlog.Add(redact(array), start, duration, proxy.ClientAddr(), proxy.serverName())
+		}
+	}
+	return err == ErrCloseClient
+}
+
+// Handles a command at the end of the interceptor chain
+func (server *Server) serveCommand(proxy *Proxy, cmd Array) (Resp, error) {
+	if len(cmd) == 0 {
+		// Rewritten away by an interceptor
+		return nil, errors.New("empty command")
+	}
+	name := strings.ToLower(cmd[0].String())
+	if handler, ok := server.commands[name]; ok {
+		return handler.ServeCommand(proxy, cmd)
+	}
+
+	switch name {
+	case "subscribe", "psubscribe", "ssubscribe":
+		if err := proxy.Passthrough(cmd); err != nil {
+			return Error("ERR " + err.Error()), ErrCloseClient
+		}
+		return nil, nil
+	}
+	reply, err := proxy.Forward(cmd)
+	if err != nil {
+		// The backend connection is unusable
+		return Error("ERR " + err.Error()), ErrCloseClient
+	}
+	proxy.trackBackendUser(cmd, reply)
+	return reply, nil
+}
+
+// PROMOTE slaveX [auth] timeout
+func (server *Server) promote(proxy *Proxy, args Array) (Resp, error) {
+	if !server.Configs.Config().Features.Promote {
+		return nil, errors.New("PROMOTE is disabled")
+	}
+	if denied := server.checkAdmin(proxy, "promote"); denied != nil {
+		return denied, nil
+	}
+	if len(args) < 3 || len(args) > 4 {
+		return Error("ERR " + wrongArgs("promote").Error()), ErrCloseClient
+	}
+	slaveID, auth, timeout := args[1].String(), "", args[len(args)-1].String()
+	if len(args) == 4 {
+		auth = args[2].String()
+	}
+	if err := proxy.Promote(slaveID, auth, timeout); err != nil {
+		server.Metrics.Promotions.WithLabelValues("failure").Inc()
+		return Error("ERR " + err.Error()), ErrCloseClient
+	}
+	server.Metrics.Promotions.WithLabelValues("success").Inc()
+
+	// Keep the config in line with the promoted backend so that
+	// REDIX CONFIG REWRITE persists it.
+	backend := url.URL{Scheme: "redis", Host: server.Dialer.Addr()}
+	if auth != "" {
+		backend.User = url.UserPassword("", auth)
+	}
+	err := server.Configs.Update(func(cfg *Config) {
+		cfg.Backend = backend.String()
+	})
+	if err != nil {
+		proxy.Logger.Error("promote: unable to update config", "error", err)
+	}
+	return SimpleString("OK"), ErrCloseClient
+}
+
+func wrongArgs(name string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// Calls f in its own goroutine once ctx is done, unless stop is called first
+func afterFunc(ctx context.Context, f func()) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+		case <-stopped:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(stopped) }) }
+}
@@ -0,0 +1,640 @@
+package redix_test
+
+import (
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+// fakeRedis is a tiny in-memory backend understanding a handful of commands
+type fakeRedis struct {
+	l    net.Listener
+	mu   sync.Mutex
+	data map[string]string
+	// Expiry of the keys that have one, in milliseconds
+	ttls map[string]string
+	// Connections subscribed to invalidations, as by CLIENT TRACKING BCAST
+	trackers []net.Conn
+	// Connections subscribed to channels and patterns
+	subscribers, psubscribers map[string][]net.Conn
+	gets                      int
+}
+
+// Call with the lock held
+func (backend *fakeRedis) invalidate(keys ...string) {
+	message := redix.Array{redix.BulkString("message"), redix.BulkString("__redis__:invalidate"), redix.Array{}}
+	for _, key := range keys {
+		message[2] = append(message[2].(redix.Array), redix.BulkString(key))
+	}
+	for _, tracker := range backend.trackers {
+		tracker.Write(message.Raw())
+	}
+}
+
+// Value returns the value of a key set on the backend
+func (backend *fakeRedis) Value(key string) (string, bool) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	value, ok := backend.data[key]
+	return value, ok
+}
+
+// TTL returns the expiry of a key in milliseconds, -1 if it has none
+func (backend *fakeRedis) TTL(key string) string {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if ttl, ok := backend.ttls[key]; ok {
+		return ttl
+	}
+	return "-1"
+}
+
+func (backend *fakeRedis) Gets() int {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	return backend.gets
+}
+
+func newFakeRedis() *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	backend := &fakeRedis{l: l, data: map[string]string{}, ttls: map[string]string{}, subscribers: map[string][]net.Conn{}, psubscribers: map[string][]net.Conn{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go backend.serve(conn)
+		}
+	}()
+	return backend
+}
+
+func (backend *fakeRedis) URL() string {
+	return "redis://" + backend.l.Addr().String()
+}
+
+func (backend *fakeRedis) Close() {
+	backend.l.Close()
+}
+
+func (backend *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := redix.NewReader(conn)
+	for {
+		resp, err := reader.ParseObject()
+		if err != nil {
+			return
+		}
+		args := resp.(redix.Array)
+		switch strings.ToLower(args[0].String()) {
+		case "debug":
+			// DEBUG SLEEP seconds
+			seconds, _ := strconv.ParseFloat(args[2].String(), 64)
+			time.Sleep(time.Duration(seconds * float64(time.Second)))
+			conn.Write(redix.SimpleString("OK").Raw())
+			continue
+		case "get":
+			// Slow reads, to be coalesced
+			if strings.HasPrefix(args[1].String(), "slow:") {
+				time.Sleep(100 * time.Millisecond)
+			}
+		case "subscribe":
+			if args[1].String() == "__redis__:invalidate" {
+				backend.mu.Lock()
+				backend.trackers = append(backend.trackers, conn)
+				conn.Write(redix.Array{redix.BulkString("subscribe"), args[1], redix.Integer("1")}.Raw())
+				backend.mu.Unlock()
+				continue
+			}
+			if args[1].String() != "flood" {
+				backend.mu.Lock()
+				for i, channel := range args[1:] {
+					backend.subscribers[channel.String()] = append(backend.subscribers[channel.String()], conn)
+					conn.Write(redix.Array{redix.BulkString("subscribe"), channel, redix.Integer(strconv.Itoa(i + 1))}.Raw())
+				}
+				backend.mu.Unlock()
+				continue
+			}
+			// Publishes to the channel until the subscriber stops reading
+			channel := redix.BulkString(args[1].String())
+			conn.Write(redix.Array{redix.BulkString("subscribe"), channel, redix.Integer("1")}.Raw())
+			message := redix.Array{redix.BulkString("message"), channel, redix.BulkString(strings.Repeat("x", 1024))}.Raw()
+			for {
+				if _, err := conn.Write(message); err != nil {
+					return
+				}
+			}
+		case "psubscribe":
+			backend.mu.Lock()
+			for i, pattern := range args[1:] {
+				backend.psubscribers[pattern.String()] = append(backend.psubscribers[pattern.String()], conn)
+				conn.Write(redix.Array{redix.BulkString("psubscribe"), pattern, redix.Integer(strconv.Itoa(i + 1))}.Raw())
+			}
+			backend.mu.Unlock()
+			continue
+		}
+		var reply redix.Resp
+		backend.mu.Lock()
+		switch strings.ToLower(args[0].String()) {
+		case "ping":
+			reply = redix.SimpleString("PONG")
+		case "echo":
+			reply = redix.BulkString(args[1].String())
+		case "set":
+			// SET key value [PX milliseconds]
+			backend.data[args[1].String()] = args[2].String()
+			delete(backend.ttls, args[1].String())
+			if len(args) == 5 && strings.ToLower(args[3].String()) == "px" {
+				backend.ttls[args[1].String()] = args[4].String()
+			}
+			backend.invalidate(args[1].String())
+			reply = redix.SimpleString("OK")
+		case "pttl":
+			if _, ok := backend.data[args[1].String()]; !ok {
+				reply = redix.Integer("-2")
+			} else if ttl, ok := backend.ttls[args[1].String()]; ok {
+				reply = redix.Integer(ttl)
+			} else {
+				reply = redix.Integer("-1")
+			}
+		case "dump":
+			// Not Redis's serialization format
+			if v, ok := backend.data[args[1].String()]; ok {
+				reply = redix.BulkString("dump:" + v)
+			} else {
+				reply = redix.BulkString(nil)
+			}
+		case "restore":
+			// RESTORE key ttl payload REPLACE
+			backend.data[args[1].String()] = strings.TrimPrefix(args[3].String(), "dump:")
+			delete(backend.ttls, args[1].String())
+			if ttl := args[2].String(); ttl != "0" {
+				backend.ttls[args[1].String()] = ttl
+			}
+			reply = redix.SimpleString("OK")
+		case "info":
+			reply = redix.BulkString("# Keyspace\r\n")
+			if len(backend.data) > 0 {
+				reply = redix.BulkString("# Keyspace\r\ndb0:keys=" + strconv.Itoa(len(backend.data)) + ",expires=0,avg_ttl=0\r\n")
+			}
+		case "client":
+			// CLIENT ID and CLIENT TRACKING
+			if strings.ToLower(args[1].String()) == "id" {
+				reply = redix.Integer("1")
+			} else {
+				reply = redix.SimpleString("OK")
+			}
+		case "get":
+			backend.gets++
+			if v, ok := backend.data[args[1].String()]; ok {
+				reply = redix.BulkString(v)
+			} else {
+				reply = redix.BulkString(nil)
+			}
+		case "unlink", "del":
+			n := 0
+			for _, key := range args[1:] {
+				if _, ok := backend.data[key.String()]; ok {
+					delete(backend.data, key.String())
+					delete(backend.ttls, key.String())
+					n++
+				}
+			}
+			reply = redix.Integer(strconv.Itoa(n))
+		case "command":
+			// A module command, a known one with movable keys, and
+			// containers described by their subcommands as by Redis 7
+			subcommand := func(name, arity string, flags []string, key string, categories ...string) redix.Array {
+				entry := redix.Array{redix.BulkString(name), redix.Integer(arity), redix.Array{}}
+				for _, flag := range flags {
+					entry[2] = append(entry[2].(redix.Array), redix.SimpleString(flag))
+				}
+				step := "1"
+				if key == "0" {
+					step = "0"
+				}
+				entry = append(entry, redix.Integer(key), redix.Integer(key), redix.Integer(step), redix.Array{})
+				for _, category := range categories {
+					entry[6] = append(entry[6].(redix.Array), redix.SimpleString(category))
+				}
+				return append(entry, redix.Array{}, redix.Array{}, redix.Array{})
+			}
+			object := subcommand("object", "-2", nil, "0", "@slow")
+			object[9] = redix.Array{subcommand("object|encoding", "3", []string{"readonly"}, "2", "@keyspace", "@read", "@slow")}
+			config := subcommand("config", "-2", nil, "0", "@slow")
+			config[9] = redix.Array{subcommand("config|set", "-4", []string{"admin", "noscript", "loading", "stale"}, "0", "@admin", "@slow", "@dangerous")}
+			reply = redix.Array{
+				object, config,
+				redix.Array{redix.BulkString("frob.get"), redix.Integer("2"), redix.Array{redix.SimpleString("readonly")},
+					redix.Integer("1"), redix.Integer("1"), redix.Integer("1"), redix.Array{redix.SimpleString("@read")}},
+				redix.Array{redix.BulkString("zunionstore"), redix.Integer("-4"), redix.Array{redix.SimpleString("write"), redix.SimpleString("movablekeys")},
+					redix.Integer("1"), redix.Integer("1"), redix.Integer("1"), redix.Array{redix.SimpleString("@write")}},
+			}
+		case "publish":
+			channel := args[1].String()
+			for _, subscriber := range backend.subscribers[channel] {
+				subscriber.Write(redix.Array{redix.BulkString("message"), args[1], args[2]}.Raw())
+			}
+			n := len(backend.subscribers[channel])
+			for pattern, subscribers := range backend.psubscribers {
+				if ok, _ := path.Match(pattern, channel); ok {
+					for _, subscriber := range subscribers {
+						subscriber.Write(redix.Array{redix.BulkString("pmessage"), redix.BulkString(pattern), args[1], args[2]}.Raw())
+					}
+					n += len(subscribers)
+				}
+			}
+			reply = redix.Integer(strconv.Itoa(n))
+		case "pubsub":
+			// PUBSUB CHANNELS pattern
+			channels := redix.Array{}
+			for channel := range backend.subscribers {
+				if ok, _ := path.Match(args[2].String(), channel); ok {
+					channels = append(channels, redix.BulkString(channel))
+				}
+			}
+			reply = channels
+		case "auth":
+			// Any user and password
+			reply = redix.SimpleString("OK")
+		case "multi", "discard":
+			// Commands run as they are sent rather than being queued
+			reply = redix.SimpleString("OK")
+		case "exec":
+			reply = redix.Array{}
+		case "flushall":
+			backend.data, backend.ttls = map[string]string{}, map[string]string{}
+			reply = redix.SimpleString("OK")
+		case "scan":
+			// SCAN cursor [MATCH pattern] [COUNT count], two keys at a time
+			pattern := "*"
+			if len(args) > 3 && strings.ToLower(args[2].String()) == "match" {
+				pattern = args[3].String()
+			}
+			var keys []string
+			for key := range backend.data {
+				if ok, _ := path.Match(pattern, key); ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			cursor, _ := strconv.Atoi(args[1].String())
+			page := redix.Array{}
+			for i := cursor; i < cursor+2 && i < len(keys); i++ {
+				page = append(page, redix.BulkString(keys[i]))
+			}
+			next := cursor + 2
+			if next >= len(keys) {
+				next = 0
+			}
+			reply = redix.Array{redix.BulkString(strconv.Itoa(next)), page}
+		default:
+			reply = redix.Error("ERR unknown command '" + args[0].String() + "'")
+		}
+		backend.mu.Unlock()
+		if _, err := conn.Write(reply.Raw()); err != nil {
+			return
+		}
+	}
+}
+
+type testClient struct {
+	conn   net.Conn
+	reader *redix.RESPReader
+}
+
+// Serves server on the listeners, or a new local one, and returns the
+// address of the first and a function shutting the server down
+func startProxy(server *redix.Server, listeners ...net.Listener) (string, func()) {
+	if len(listeners) == 0 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		listeners = append(listeners, l)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, l := range listeners {
+		go server.Serve(ctx, l)
+	}
+	return listeners[0].Addr().String(), func() {
+		shutdownCtx, done := context.WithTimeout(context.Background(), time.Second)
+		defer done()
+		server.Shutdown(shutdownCtx)
+		cancel()
+	}
+}
+
+func dialProxy(addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	Expect(err).To(BeNil())
+	return &testClient{conn: conn, reader: redix.NewReader(conn)}
+}
+
+func (client *testClient) Do(args ...string) redix.Resp {
+	var cmd redix.Array
+	for _, arg := range args {
+		cmd = append(cmd, redix.BulkString(arg))
+	}
+	_, err := client.conn.Write(cmd.Raw())
+	Expect(err).To(BeNil())
+	resp, err := client.reader.ParseObject()
+	Expect(err).To(BeNil())
+	return resp
+}
+
+func (client *testClient) Close() {
+	client.conn.Close()
+}
+
+var _ = Describe("Server", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+		client  *testClient
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		server = redix.NewServer(redix.StaticConfig(cfg))
+	})
+
+	JustBeforeEach(func() {
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+	})
+
+	It("Should forward commands to the backend.", func() {
+		Expect(client.Do("SET", "foo", "bar").String()).To(Equal("OK"))
+		Expect(client.Do("GET", "foo").String()).To(Equal("bar"))
+	})
+	It("Should forward null replies.", func() {
+		Expect(client.Do("GET", "missing")).To(Equal(redix.BulkString(nil)))
+		Expect(client.Do("ECHO", "")).To(Equal(redix.BulkString{}))
+	})
+	It("Should answer REDIX INFO.", func() {
+		info := client.Do("REDIX", "INFO").String()
+		Expect(info).To(ContainSubstring("redix_version:" + redix.Version))
+		Expect(info).To(ContainSubstring("connected_clients:1"))
+		Expect(info).To(ContainSubstring("backend:" + backend.l.Addr().String()))
+	})
+	It("Should list clients with their last command.", func() {
+		client.Do("PING")
+		clients := client.Do("REDIX", "CLIENTS").String()
+		Expect(clients).To(ContainSubstring("addr=" + client.conn.LocalAddr().String()))
+		Expect(clients).To(ContainSubstring("cmd=redix"))
+	})
+	It("Should kill clients by address.", func() {
+		other := dialProxy(addr)
+		defer other.Close()
+		other.Do("PING")
+
+		Expect(client.Do("REDIX", "KILL", other.conn.LocalAddr().String()).String()).To(Equal("OK"))
+		_, err := other.reader.ParseObject()
+		Expect(err).NotTo(BeNil())
+
+		Expect(client.Do("REDIX", "KILL", "1.2.3.4:5").String()).To(Equal("ERR No such client"))
+	})
+	It("Should get and set config parameters.", func() {
+		Expect(client.Do("REDIX", "CONFIG", "SET", "limits.max_clients", "10").String()).To(Equal("OK"))
+		Expect(client.Do("REDIX", "CONFIG", "GET", "limits.max*").String()).To(Equal("[limits.max_clients 10]"))
+		Expect(client.Do("REDIX", "CONFIG", "SET", "limits.nope", "10")).To(BeAssignableToTypeOf(redix.Error{}))
+		Expect(client.Do("REDIX", "CONFIG", "REWRITE")).To(BeAssignableToTypeOf(redix.Error{}))
+	})
+	It("Should keep slow commands in the slowlog.", func() {
+		Expect(client.Do("REDIX", "CONFIG", "SET", "slowlog.threshold", "0s").String()).To(Equal("OK"))
+		client.Do("GET", "foo")
+		// Includes the CONFIG SET
+		Expect(client.Do("REDIX", "SLOWLOG", "LEN").String()).To(Equal("2"))
+
+		// Newest first, after the LEN
+		entries := client.Do("REDIX", "SLOWLOG", "GET", "2").(redix.Array)
+		Expect(entries).To(HaveLen(2))
+		entry := entries[1].(redix.Array)
+		Expect(entry[3].String()).To(Equal("[GET foo]"))
+		Expect(entry[4].String()).To(Equal(client.conn.LocalAddr().String()))
+		Expect(entry[5].String()).To(Equal(backend.l.Addr().String()))
+
+		Expect(client.Do("REDIX", "SLOWLOG", "RESET").String()).To(Equal("OK"))
+		Expect(client.Do("REDIX", "SLOWLOG", "LEN").String()).To(Equal("1"))
+	})
+	It("Should redact credentials in the slowlog.", func() {
+		Expect(client.Do("REDIX", "CONFIG", "SET", "slowlog.threshold", "0s").String()).To(Equal("OK"))
+		client.Do("AUTH", "hunter2")
+
+		entries := client.Do("REDIX", "SLOWLOG", "GET", "2").(redix.Array)
+		Expect(entries[0].(redix.Array)[3].String()).To(Equal("[AUTH (redacted)]"))
+	})
+	It("Should reject unknown subcommands.", func() {
+		Expect(client.Do("REDIX", "NOPE")).To(BeAssignableToTypeOf(redix.Error{}))
+	})
+
+	Context("With custom command handlers", func() {
+		BeforeEach(func() {
+			server.HandleFunc("hello-world", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+				return redix.BulkString("hello " + cmd[1].String()), nil
+			})
+			// Rewrites GET key into GET prefix:key
+			server.HandleFunc("get", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+				return proxy.Forward(redix.Array{cmd[0], redix.BulkString("prefix:" + cmd[1].String())})
+			})
+			server.HandleFunc("limited", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+				return redix.Error("LIMITED try again later"), nil
+			})
+		})
+
+		It("Should reply locally.", func() {
+			Expect(client.Do("HELLO-WORLD", "redix").String()).To(Equal("hello redix"))
+		})
+		It("Should rewrite and forward.", func() {
+			client.Do("SET", "prefix:foo", "bar")
+			Expect(client.Do("GET", "foo").String()).To(Equal("bar"))
+		})
+		It("Should reject with a custom prefix.", func() {
+			Expect(client.Do("LIMITED")).To(Equal(redix.Error("LIMITED try again later")))
+		})
+	})
+	Context("With admins", func() {
+		BeforeEach(func() {
+			cfg := server.Configs.Config()
+			cfg.Auth.Users = map[string]string{"alice": "a", "bob": "b"}
+			cfg.Auth.Admins = []string{"alice"}
+			server = redix.NewServer(redix.StaticConfig(cfg))
+		})
+
+		It("Should only let admins change the proxy.", func() {
+			Expect(client.Do("AUTH", "bob", "b").String()).To(Equal("OK"))
+			Expect(client.Do("REDIX", "CONFIG", "SET", "limits.max_clients", "10")).To(Equal(redix.Error("NOPERM User bob has no permissions to run the 'redix|config|set' command")))
+			Expect(client.Do("REDIX", "UPGRADE")).To(Equal(redix.Error("NOPERM User bob has no permissions to run the 'redix|upgrade' command")))
+			Expect(client.Do("REDIX", "CONFIG", "GET", "limits.max_clients").String()).To(Equal("[limits.max_clients 0]"))
+
+			Expect(client.Do("AUTH", "alice", "a").String()).To(Equal("OK"))
+			Expect(client.Do("REDIX", "CONFIG", "SET", "limits.max_clients", "10").String()).To(Equal("OK"))
+			// Credentials are only set in the file
+			Expect(client.Do("REDIX", "CONFIG", "SET", "auth.password", "mine")).To(BeAssignableToTypeOf(redix.Error{}))
+		})
+	})
+	Context("With auth and no admins", func() {
+		BeforeEach(func() {
+			cfg := server.Configs.Config()
+			cfg.Auth.Password = "secret"
+			server = redix.NewServer(redix.StaticConfig(cfg))
+		})
+
+		It("Should let no one change the proxy.", func() {
+			Expect(client.Do("AUTH", "secret").String()).To(Equal("OK"))
+			Expect(client.Do("REDIX", "CONFIG", "SET", "backend", "redis://127.0.0.1:1")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'redix|config|set' command")))
+			Expect(client.Do("REDIX", "TAP", "*")).To(BeAssignableToTypeOf(redix.Error{}))
+			Expect(client.Do("REDIX", "SLOWLOG", "RESET")).To(BeAssignableToTypeOf(redix.Error{}))
+			Expect(client.Do("REDIX", "SLOWLOG", "GET")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'redix|slowlog|get' command")))
+			Expect(client.Do("REDIX", "HOTKEYS")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'redix|hotkeys' command")))
+			Expect(client.Do("REDIX", "BIGKEYS")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'redix|bigkeys' command")))
+			Expect(client.Do("MONITOR")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'monitor' command")))
+			Expect(client.Do("PROMOTE", "slave0", "1000")).To(Equal(redix.Error("NOPERM User default has no permissions to run the 'promote' command")))
+			Expect(client.Do("REDIX", "SLOWLOG", "LEN")).To(BeAssignableToTypeOf(redix.Integer("")))
+		})
+	})
+	Context("With timeouts and limits", func() {
+		BeforeEach(func() {
+			cfg := server.Configs.Config()
+			cfg.Timeouts.Idle = redix.Duration(100 * time.Millisecond)
+			cfg.Timeouts.Command = redix.Duration(100 * time.Millisecond)
+			cfg.Limits.OutputBuffer = redix.OutputBufferConfig{HardBytes: 1 << 20}
+			server = redix.NewServer(redix.StaticConfig(cfg))
+		})
+
+		It("Should close idle clients.", func() {
+			Expect(client.Do("PING").String()).To(Equal("PONG"))
+			client.conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err := client.reader.ParseObject()
+			Expect(err).To(Equal(io.EOF))
+		})
+		It("Should close clients whose command times out.", func() {
+			Expect(client.Do("DEBUG", "SLEEP", "0.01").String()).To(Equal("OK"))
+			Expect(client.Do("DEBUG", "SLEEP", "0.5").String()).To(Equal("ERR backend timed out"))
+			_, err := client.reader.ParseObject()
+			Expect(err).NotTo(BeNil())
+		})
+		It("Should close subscribers that fall behind.", func() {
+			// The client never reads the messages
+			_, err := client.conn.Write(redix.Array{redix.BulkString("SUBSCRIBE"), redix.BulkString("flood")}.Raw())
+			Expect(err).To(BeNil())
+			Eventually(server.NumClients, 5*time.Second).Should(Equal(0))
+		})
+	})
+
+	Context("With a max number of clients", func() {
+		var unresponsive net.Listener
+
+		BeforeEach(func() {
+			// Clients wait for it to answer AUTH
+			var err error
+			unresponsive, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			cfg := server.Configs.Config()
+			cfg.Backend = "redis://:secret@" + unresponsive.Addr().String()
+			cfg.Limits.MaxClients = 1
+			server = redix.NewServer(redix.StaticConfig(cfg))
+		})
+
+		AfterEach(func() {
+			unresponsive.Close()
+		})
+
+		It("Should count clients still connecting to the backend.", func() {
+			other := dialProxy(addr)
+			defer other.Close()
+			Expect(other.reader.ParseObject()).To(Equal(redix.Error("ERR max number of clients reached")))
+		})
+	})
+
+	Context("When shutting down", func() {
+		var release chan struct{}
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			released := release
+			server.HandleFunc("slow", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+				<-released
+				return redix.SimpleString("DONE"), nil
+			})
+		})
+
+		It("Should let in-flight commands finish.", func() {
+			idle := dialProxy(addr)
+			defer idle.Close()
+			idle.Do("PING")
+
+			replies := make(chan redix.Resp)
+			go func() {
+				defer GinkgoRecover()
+				replies <- client.Do("SLOW")
+			}()
+			Eventually(func() string { return idle.Do("REDIX", "CLIENTS").String() }).Should(ContainSubstring("cmd=slow"))
+
+			shutdown := make(chan error)
+			go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+			// Idle clients are closed right away
+			_, err := idle.reader.ParseObject()
+			Expect(err).NotTo(BeNil())
+			Consistently(shutdown).ShouldNot(Receive())
+
+			close(release)
+			Expect((<-replies).String()).To(Equal("DONE"))
+			Eventually(shutdown).Should(Receive(BeNil()))
+			_, err = client.reader.ParseObject()
+			Expect(err).NotTo(BeNil())
+		})
+		It("Should close busy clients once the context is done.", func() {
+			_, err := client.conn.Write(redix.Array{redix.BulkString("SLOW")}.Raw())
+			Expect(err).To(BeNil())
+			Eventually(func() string {
+				var info string
+				for _, proxy := range server.Clients() {
+					info += proxy.ClientInfo()
+				}
+				return info
+			}).Should(ContainSubstring("cmd=slow"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).To(Equal(context.DeadlineExceeded))
+			_, err = client.reader.ParseObject()
+			Expect(err).NotTo(BeNil())
+
+			close(release)
+			Eventually(server.NumClients).Should(Equal(0))
+		})
+		It("Should stop serving.", func() {
+			other, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			served := make(chan error)
+			go func() { served <- server.Serve(context.Background(), other) }()
+
+			Expect(server.Shutdown(context.Background())).To(Succeed())
+			Eventually(served).Should(Receive(Equal(redix.ErrServerClosed)))
+			Expect(server.Serve(context.Background(), other)).To(Equal(redix.ErrServerClosed))
+		})
+	})
+})
@@ -0,0 +1,187 @@
+package redix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Like Redis, args are truncated before they are kept
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+// SlowlogEntry is a command that took longer than the slowlog threshold,
+// measured from reading it off the client connection to writing its reply.
+type SlowlogEntry struct {
+	ID         int64
+	Time       time.Time
+	Duration   time.Duration
+	Args       []string
+	ClientAddr string
+	Backend    string
+}
+
+// Slowlog keeps the most recent slow commands in a ring buffer
+type Slowlog struct {
+	mu      sync.Mutex
+	entries []SlowlogEntry
+	next    int // where the next entry goes
+	full    bool
+	id      int64
+}
+
+func NewSlowlog(maxLen int) *Slowlog {
+	return &Slowlog{entries: make([]SlowlogEntry, maxLen)}
+}
+
+// Add records a command, truncating its args
+func (slowlog *Slowlog) Add(cmd Array, start time.Time, duration time.Duration, clientAddr, backend string) {
+	argc := len(cmd)
+	if argc > slowlogMaxArgc {
+		argc = slowlogMaxArgc
+	}
+	args := make([]string, argc)
+	for i := 0; i < argc; i++ {
+		if i == slowlogMaxArgc-1 && len(cmd) > slowlogMaxArgc {
+			args[i] = fmt.Sprintf("... (%d more arguments)", len(cmd)-slowlogMaxArgc+1)
+			break
+		}
+		arg := cmd[i].String()
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		args[i] = arg
+	}
+
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+
+	if len(slowlog.entries) == 0 {
+		return
+	}
+	slowlog.entries[slowlog.next] = SlowlogEntry{
+		ID:         slowlog.id,
+		Time:       start,
+		Duration:   duration,
+		Args:       args,
+		ClientAddr: clientAddr,
+		Backend:    backend,
+	}
+	slowlog.id++
+	slowlog.next = (slowlog.next + 1) % len(slowlog.entries)
+	if slowlog.next == 0 {
+		slowlog.full = true
+	}
+}
+
+// Get returns up to n entries, newest first. A negative n returns them all.
+func (slowlog *Slowlog) Get(n int) []SlowlogEntry {
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+
+	size := slowlog.len()
+	if n < 0 || n > size {
+		n = size
+	}
+	entries := make([]SlowlogEntry, n)
+	for i := 0; i < n; i++ {
+		j := (slowlog.next - 1 - i + len(slowlog.entries)) % len(slowlog.entries)
+		entries[i] = slowlog.entries[j]
+	}
+	return entries
+}
+
+func (slowlog *Slowlog) Len() int {
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+	return slowlog.len()
+}
+
+func (slowlog *Slowlog) len() int {
+	if slowlog.full {
+		return len(slowlog.entries)
+	}
+	return slowlog.next
+}
+
+func (slowlog *Slowlog) Reset() {
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+
+	slowlog.entries = make([]SlowlogEntry, len(slowlog.entries))
+	slowlog.next, slowlog.full = 0, false
+}
+
+// Resize changes the number of entries kept, keeping the newest ones
+func (slowlog *Slowlog) Resize(maxLen int) {
+	entries := slowlog.Get(maxLen)
+
+	slowlog.mu.Lock()
+	defer slowlog.mu.Unlock()
+
+	if maxLen == len(slowlog.entries) {
+		return
+	}
+	slowlog.entries = make([]SlowlogEntry, maxLen)
+	slowlog.next, slowlog.full = 0, false
+	for i := len(entries) - 1; i >= 0; i-- {
+		slowlog.entries[slowlog.next] = entries[i]
+		slowlog.next = (slowlog.next + 1) % maxLen
+		if slowlog.next == 0 {
+			slowlog.full = true
+		}
+	}
+}
+
+// Reply renders an entry as SLOWLOG GET does. The last field, which is the
+// client name in Redis, is the backend the command was sent to.
+func (entry SlowlogEntry) Reply() Array {
+	args := make(Array, len(entry.Args))
+	for i, arg := range entry.Args {
+		args[i] = BulkString(arg)
+	}
+	return Array{
+		Integer(strconv.FormatInt(entry.ID, 10)),
+		Integer(strconv.FormatInt(entry.Time.Unix(), 10)),
+		Integer(strconv.FormatInt(entry.Duration.Nanoseconds()/1000, 10)),
+		args,
+		BulkString(entry.ClientAddr),
+		BulkString(entry.Backend),
+	}
+}
+
+// REDIX SLOWLOG GET [count] | LEN | RESET
+func (server *Server) slowlogCommand(proxy *Proxy, args Array) (Resp, error) {
+	if len(args) < 3 {
+		return nil, wrongArgs("redix|slowlog")
+	}
+	switch strings.ToLower(args[2].String()) {
+	case "get":
+		count := 10
+		if len(args) == 4 {
+			n, err := strconv.Atoi(args[3].String())
+			if err != nil || n < -1 {
+				return nil, fmt.Errorf("count should be greater than or equal to -1")
+			}
+			count = n
+		} else if len(args) > 4 {
+			return nil, wrongArgs("redix|slowlog|get")
+		}
+		entries := Array{}
+		for _, entry := range server.Slowlog.Get(count) {
+			entries = append(entries, entry.Reply())
+		}
+		return entries, nil
+	case "len":
+		return Integer(strconv.Itoa(server.Slowlog.Len())), nil
+	case "reset":
+		server.Slowlog.Reset()
+		return SimpleString("OK"), nil
+	default:
+		return nil, fmt.Errorf("unknown subcommand '%s'. Try REDIX HELP.", args[2].String())
+	}
+}
@@ -0,0 +1,68 @@
+package redix_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Slowlog", func() {
+	cmd := func(args ...string) redix.Array {
+		var array redix.Array
+		for _, arg := range args {
+			array = append(array, redix.BulkString(arg))
+		}
+		return array
+	}
+
+	It("Should keep the newest entries.", func() {
+		slowlog := redix.NewSlowlog(2)
+		slowlog.Add(cmd("GET", "a"), time.Now(), time.Second, "client", "backend")
+		slowlog.Add(cmd("GET", "b"), time.Now(), time.Second, "client", "backend")
+		slowlog.Add(cmd("GET", "c"), time.Now(), time.Second, "client", "backend")
+
+		Expect(slowlog.Len()).To(Equal(2))
+		entries := slowlog.Get(-1)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Args).To(Equal([]string{"GET", "c"}))
+		Expect(entries[0].ID).To(Equal(int64(2)))
+		Expect(entries[1].Args).To(Equal([]string{"GET", "b"}))
+		Expect(slowlog.Get(1)).To(HaveLen(1))
+	})
+	It("Should truncate args.", func() {
+		slowlog := redix.NewSlowlog(1)
+		args := []string{"MSET"}
+		for i := 0; i < 40; i++ {
+			args = append(args, strings.Repeat("x", 130))
+		}
+		slowlog.Add(cmd(args...), time.Now(), time.Second, "client", "backend")
+
+		entry := slowlog.Get(1)[0]
+		Expect(entry.Args).To(HaveLen(32))
+		Expect(entry.Args[1]).To(Equal(strings.Repeat("x", 128) + "... (2 more bytes)"))
+		Expect(entry.Args[31]).To(Equal("... (10 more arguments)"))
+	})
+	It("Should reset and resize.", func() {
+		slowlog := redix.NewSlowlog(3)
+		slowlog.Add(cmd("GET", "a"), time.Now(), time.Second, "client", "backend")
+		slowlog.Add(cmd("GET", "b"), time.Now(), time.Second, "client", "backend")
+		slowlog.Add(cmd("GET", "c"), time.Now(), time.Second, "client", "backend")
+
+		slowlog.Resize(2)
+		entries := slowlog.Get(-1)
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Args).To(Equal([]string{"GET", "c"}))
+		Expect(entries[1].Args).To(Equal([]string{"GET", "b"}))
+
+		slowlog.Reset()
+		Expect(slowlog.Len()).To(Equal(0))
+	})
+	It("Should render entries as SLOWLOG GET does.", func() {
+		slowlog := redix.NewSlowlog(1)
+		slowlog.Add(cmd("GET", "a"), time.Unix(1500000000, 0), 1500*time.Microsecond, "1.2.3.4:5", "6.7.8.9:6379")
+		Expect(slowlog.Get(1)[0].Reply().String()).To(Equal("[0 1500000000 1500 [GET a] 1.2.3.4:5 6.7.8.9:6379]"))
+	})
+})
@@ -0,0 +1,127 @@
+package redix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/context"
+)
+
+const tracerName = "github.com/kevin-cantwell/redix"
+
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// NewTracerProvider builds the OpenTelemetry tracer provider described by
+// cfg. It returns nil if tracing is disabled. Callers must Shutdown the
+// provider to flush spans before exiting.
+func NewTracerProvider(cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "":
+		return nil, nil
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		otlp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		exporter = fileExporter{SpanExporter: stdout, f: f}
+	default:
+		return nil, errors.New("unknown tracing exporter " + cfg.Exporter)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	), nil
+}
+
+// Closes the file once the exporter is shut down
+type fileExporter struct {
+	sdktrace.SpanExporter
+	f *os.File
+}
+
+func (exporter fileExporter) Shutdown(ctx context.Context) error {
+	err := exporter.SpanExporter.Shutdown(ctx)
+	if cerr := exporter.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Starts a span per command, recording its name, a hash of its first key,
+// the backend and the type of reply
+func (server *Server) traceCommands(ctx context.Context, cmd Array, next Handler) (Resp, error) {
+	proxy, ok := ProxyFromContext(ctx)
+	if !ok {
+		return next(ctx, cmd)
+	}
+	name := strings.ToUpper(commandLabel(cmd))
+	ctx, span := proxy.Tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.system.name", "redis"),
+		attribute.String("db.operation.name", name),
+		attribute.String("server.address", proxy.serverName()),
+		attribute.String("client.address", proxy.ClientAddr()),
+	)
+	if info, known := lookupCommand(cmd); known {
+		if keys, err := info.Keys(cmd); err == nil && len(keys) > 0 {
+			span.SetAttributes(attribute.String("redix.key.hash", hashKey(keys[0])))
+		}
+	}
+
+	reply, err := next(ctx, cmd)
+	if reply != nil {
+		span.SetAttributes(attribute.String("redix.reply.type", replyType(reply)))
+	}
+	if e, ok := reply.(Error); ok {
+		span.SetStatus(codes.Error, e.String())
+	} else if err != nil && err != ErrCloseClient {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return reply, err
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Keys may contain personal data, so spans only carry a short hash of them
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
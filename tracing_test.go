@@ -0,0 +1,84 @@
+package redix_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		backend  *fakeRedis
+		server   *redix.Server
+		addr     string
+		stop     func()
+		client   *testClient
+		provider *sdktrace.TracerProvider
+		dir      string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "redix")
+		Expect(err).To(BeNil())
+
+		backend = newFakeRedis()
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		cfg.Tracing.Exporter = "file"
+		cfg.Tracing.File = filepath.Join(dir, "spans.json")
+		Expect(cfg.Validate()).To(Succeed())
+		server = redix.NewServer(redix.StaticConfig(cfg))
+
+		provider, err = redix.NewTracerProvider(cfg.Tracing)
+		Expect(err).To(BeNil())
+		server.Tracer = provider.Tracer("test")
+
+		addr, stop = startProxy(server)
+		client = dialProxy(addr)
+	})
+
+	AfterEach(func() {
+		client.Close()
+		stop()
+		backend.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("Should export a span per command.", func() {
+		client.Do("GET", "secret-key")
+		client.Do("NOPE")
+		Expect(provider.Shutdown(context.Background())).To(Succeed())
+
+		spans, err := ioutil.ReadFile(filepath.Join(dir, "spans.json"))
+		Expect(err).To(BeNil())
+		Expect(string(spans)).To(ContainSubstring(`"Name":"GET"`))
+		Expect(string(spans)).To(ContainSubstring(`"Name":"OTHER"`))
+		Expect(string(spans)).To(ContainSubstring(`"redix.key.hash"`))
+		Expect(string(spans)).To(ContainSubstring(backend.l.Addr().String()))
+		Expect(string(spans)).To(ContainSubstring(`"Code":"Error"`))
+		Expect(string(spans)).NotTo(ContainSubstring("secret-key"))
+	})
+	It("Should only hash keys.", func() {
+		client.Do("ECHO", "hello")
+		client.Do("EVAL", "return 1", "1", "secret-key")
+		Expect(provider.Shutdown(context.Background())).To(Succeed())
+
+		spans, err := ioutil.ReadFile(filepath.Join(dir, "spans.json"))
+		Expect(err).To(BeNil())
+		lines := strings.Split(strings.TrimSpace(string(spans)), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).NotTo(ContainSubstring(`"redix.key.hash"`))
+		sum := sha256.Sum256([]byte("secret-key"))
+		Expect(lines[1]).To(ContainSubstring(hex.EncodeToString(sum[:8])))
+	})
+})
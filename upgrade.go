@@ -0,0 +1,168 @@
+package redix
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set in the environment of a process started by Upgrade to the number of
+// listeners it inherits. They are passed as fds 3 and up, followed by the
+// pipe used to tell the parent that the process is ready.
+const upgradeEnv = "REDIX_UPGRADE_FDS"
+
+// How long Upgrade waits for the new process to be ready
+const upgradeTimeout = 30 * time.Second
+
+var ErrUpgraded = errors.New("redix: Server already upgraded")
+
+var ready struct {
+	once sync.Once
+	pipe *os.File
+}
+
+// InheritedListeners returns the listeners handed down by the process that
+// upgraded to this one, or nil if this process wasn't started by Upgrade.
+func InheritedListeners() ([]net.Listener, error) {
+	env := os.Getenv(upgradeEnv)
+	if env == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", upgradeEnv, env)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	ready.pipe = os.NewFile(uintptr(3+n), "ready")
+	return listeners, nil
+}
+
+// NotifyUpgraded tells the process that upgraded to this one that it is
+// serving its inherited listeners, so that the old process can drain and
+// exit. It does nothing if InheritedListeners returned no listeners.
+func NotifyUpgraded() error {
+	var err error
+	ready.once.Do(func() {
+		if ready.pipe == nil {
+			return
+		}
+		_, err = ready.pipe.Write([]byte{1})
+		if cerr := ready.pipe.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// Upgrade execs a new copy of the running binary with the same arguments,
+// handing it every listener being served. It returns once the new process
+// has called NotifyUpgraded, after which both processes accept connections
+// until this one is shut down. The new process is killed if it fails to
+// become ready. OnUpgrade is called on success. It fails if no listener is
+// being served, or if runtime config changes haven't been rewritten to the
+// file the new process reads.
+func (server *Server) Upgrade() (*os.Process, error) {
+	server.mu.Lock()
+	if server.draining {
+		server.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	if server.upgraded {
+		server.mu.Unlock()
+		return nil, ErrUpgraded
+	}
+	if server.Configs.Unpersisted() {
+		// The new process reads the config file
+		server.mu.Unlock()
+		return nil, errors.New("redix: runtime config changes aren't persisted, run REDIX CONFIG REWRITE first")
+	}
+	var files []*os.File
+	for l := range server.listeners {
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := filer.File()
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		// The new process would bind the configured addresses instead
+		server.mu.Unlock()
+		return nil, errors.New("redix: no listeners to hand over")
+	}
+	server.upgraded = true
+	server.mu.Unlock()
+
+	child, err := server.startUpgrade(files)
+	if err != nil {
+		server.mu.Lock()
+		server.upgraded = false
+		server.mu.Unlock()
+		return nil, err
+	}
+	server.Logger.Info("Upgraded", "pid", child.Pid, "listeners", len(files))
+	if server.OnUpgrade != nil {
+		server.OnUpgrade(child)
+	}
+	return child, nil
+}
+
+func (server *Server) startUpgrade(files []*os.File) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, upgradeEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"="+strconv.Itoa(len(files)))
+
+	err = cmd.Start()
+	// Only the child writes, so reads see EOF if it exits early
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("upgraded process failed to start: %v", err)
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,92 @@
+package redix_test
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/kevin-cantwell/redix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+// Set by the upgrade test for the test binary it execs
+const upgradeBackendEnv = "REDIX_TEST_UPGRADE_BACKEND"
+
+// Run by the test binary when it is started by Upgrade. Serves the
+// inherited listeners until killed, replying to PID with its process id.
+func serveUpgraded() {
+	listeners, err := redix.InheritedListeners()
+	if err != nil {
+		panic(err)
+	}
+	cfg := redix.DefaultConfig()
+	cfg.Backend = os.Getenv(upgradeBackendEnv)
+	server := redix.NewServer(redix.StaticConfig(cfg))
+	server.HandleFunc("pid", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+		return redix.Integer(strconv.Itoa(os.Getpid())), nil
+	})
+	for _, l := range listeners {
+		go server.Serve(context.Background(), l)
+	}
+	if err := redix.NotifyUpgraded(); err != nil {
+		panic(err)
+	}
+	select {}
+}
+
+var _ = Describe("Upgrade", func() {
+	var (
+		backend *fakeRedis
+		server  *redix.Server
+		addr    string
+		stop    func()
+	)
+
+	BeforeEach(func() {
+		backend = newFakeRedis()
+		os.Setenv(upgradeBackendEnv, backend.URL())
+		cfg := redix.DefaultConfig()
+		cfg.Backend = backend.URL()
+		server = redix.NewServer(redix.StaticConfig(cfg))
+		server.HandleFunc("pid", func(proxy *redix.Proxy, cmd redix.Array) (redix.Resp, error) {
+			return redix.Integer(strconv.Itoa(os.Getpid())), nil
+		})
+		addr, stop = startProxy(server)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(upgradeBackendEnv)
+		stop()
+		backend.Close()
+	})
+
+	It("Should hand the listeners to a new process.", func() {
+		var child *os.Process
+		server.OnUpgrade = func(p *os.Process) { child = p }
+
+		client := dialProxy(addr)
+		defer client.Close()
+		Expect(client.Do("PID").String()).To(Equal(strconv.Itoa(os.Getpid())))
+		Expect(client.Do("REDIX", "UPGRADE").String()).To(Equal("OK"))
+		Expect(child).NotTo(BeNil())
+		defer func() {
+			child.Kill()
+			child.Wait()
+		}()
+		_, err := server.Upgrade()
+		Expect(err).To(Equal(redix.ErrUpgraded))
+
+		Expect(server.Shutdown(context.Background())).To(Succeed())
+		// The listening socket outlives the old process's copy of it
+		upgraded := dialProxy(addr)
+		defer upgraded.Close()
+		Expect(upgraded.Do("PID").String()).To(Equal(strconv.Itoa(child.Pid)))
+	})
+	It("Should not upgrade without listeners.", func() {
+		idle := redix.NewServer(redix.StaticConfig(server.Configs.Config()))
+		child, err := idle.Upgrade()
+		Expect(err).NotTo(BeNil())
+		Expect(child).To(BeNil())
+	})
+})